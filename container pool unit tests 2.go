@@ -1,13 +1,22 @@
 package containerpool
 
 import (
+	"bufio"
 	"context"
 	"datafeedctl/internal/app/logz"
+	"encoding/json"
+	"errors"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/spf13/viper"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -96,6 +105,70 @@ func TestContainerPool_GetContainer(t *testing.T) {
 	}
 }
 
+func TestContainerPool_GetContainer_BoundedDeadContainers(t *testing.T) {
+	mockClient := &mockDockerClient{}
+	cp, _ := NewContainerPool(2, 2, time.Minute*10, "test/image")
+	cp.client = mockClient
+	cp.maxAcquireAttempts = 4
+
+	// Every container handed back is dead, far more than the attempt limit
+	mockClient.aliveStatus = []bool{false, false, false, false, false, false, false, false}
+	before := cp.Stats()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cp.GetContainerContext(context.Background())
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("GetContainerContext() expected error after %d dead containers", cp.maxAcquireAttempts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetContainerContext() did not fail within a bounded number of attempts")
+	}
+
+	// Giving up must not leak the last replacement out of the pool
+	after := cp.Stats()
+	if after.Total != before.Total || after.Free != before.Free {
+		t.Errorf("Stats() after giving up = %+v, want Total %d and Free %d", after, before.Total, before.Free)
+	}
+	if len(cp.availableContainers) != after.Free {
+		t.Errorf("expected %d available containers, got %d", after.Free, len(cp.availableContainers))
+	}
+}
+
+func TestContainerPool_GetContainerContext(t *testing.T) {
+	cp, _ := NewContainerPool(2, 2, time.Minute*10, "test/image")
+
+	// Pool is at max capacity with nothing available
+	cp.containersList = []*DockerContainer{
+		{ID: "container1", State: Busy},
+		{ID: "container2", State: Busy},
+	}
+	cp.availableContainers = make(chan *DockerContainer, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	con, err := cp.GetContainerContext(ctx)
+	if err == nil {
+		t.Errorf("GetContainerContext() expected error when context deadline passes, got container %v", con)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GetContainerContext() did not return promptly after deadline, took %v", elapsed)
+	}
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err := cp.GetContainerContext(canceled); err == nil {
+		t.Errorf("GetContainerContext() expected error for an already canceled context")
+	}
+}
+
 func TestContainerPool_ReleaseContainer(t *testing.T) {
 	cp, _ := NewContainerPool(2, 5, time.Minute*10, "test/image")
 
@@ -135,6 +208,44 @@ func TestContainerPool_ReleaseContainer(t *testing.T) {
 	}
 }
 
+func TestContainerPool_ReleaseContainer_ChannelFull(t *testing.T) {
+	mockClient := &mockDockerClient{}
+	cp, _ := NewContainerPool(0, 5, time.Minute*10, "test/image")
+	cp.client = mockClient
+	cp.availableContainers = make(chan *DockerContainer, 1)
+
+	con1 := &DockerContainer{ID: "container1", State: Busy}
+	con2 := &DockerContainer{ID: "container2", State: Busy}
+	cp.containersList = []*DockerContainer{con1, con2}
+	cp.lastUsedTime = map[string]time.Time{
+		"container1": time.Now(),
+		"container2": time.Now(),
+	}
+
+	released := make(chan struct{})
+	go func() {
+		cp.ReleaseContainer(con1)
+		cp.ReleaseContainer(con2)
+		close(released)
+	}()
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("ReleaseContainer() blocked on a full channel")
+	}
+
+	if len(cp.availableContainers) != 1 {
+		t.Errorf("ReleaseContainer() left %d containers available, want 1", len(cp.availableContainers))
+	}
+	if _, ok := cp.lastUsedTime["container2"]; ok {
+		t.Errorf("ReleaseContainer() did not remove the container that overflowed the channel")
+	}
+	if len(cp.containersList) != 1 {
+		t.Errorf("ReleaseContainer() left %d containers in the pool, want 1", len(cp.containersList))
+	}
+}
+
 func TestContainerPool_CheckContainerAlive(t *testing.T) {
 	// Mock the Docker client
 	mockClient := &mockDockerClient{}
@@ -205,9 +316,875 @@ func TestContainerPool_cleanupIdleContainers(t *testing.T) {
 	}
 }
 
+func TestContainerPool_recycleExpiredContainers(t *testing.T) {
+	mockClient := &mockDockerClient{}
+	cp, _ := NewContainerPool(2, 5, time.Minute*5, "test/image")
+	cp.client = mockClient
+	cp.maxLifetime = time.Hour
+	cp.availableContainers = make(chan *DockerContainer, 5)
+
+	// container1 was used a moment ago but has outlived maxLifetime
+	con1 := &DockerContainer{ID: "container1", State: Free}
+	con2 := &DockerContainer{ID: "container2", State: Free}
+	con3 := &DockerContainer{ID: "container3", State: Busy}
+	cp.containersList = []*DockerContainer{con1, con2, con3}
+	cp.lastUsedTime = map[string]time.Time{
+		"container1": time.Now(),
+		"container2": time.Now(),
+		"container3": time.Now(),
+	}
+	cp.createdTime = map[string]time.Time{
+		"container1": time.Now().Add(-time.Hour * 2),
+		"container2": time.Now().Add(-time.Minute * 10),
+		"container3": time.Now().Add(-time.Hour * 3),
+	}
+	cp.availableContainers <- con1
+	cp.availableContainers <- con2
+
+	cp.recycleExpiredContainers()
+
+	if _, ok := cp.lastUsedTime["container1"]; ok {
+		t.Errorf("recycleExpiredContainers() did not recycle expired free container container1")
+	}
+	if _, ok := cp.lastUsedTime["container2"]; !ok {
+		t.Errorf("recycleExpiredContainers() recycled container2 before its max lifetime")
+	}
+	if _, ok := cp.lastUsedTime["container3"]; !ok {
+		t.Errorf("recycleExpiredContainers() removed busy container container3")
+	}
+	if !cp.recycleOnRelease["container3"] {
+		t.Errorf("recycleExpiredContainers() did not flag busy container container3 for recycling")
+	}
+	if len(cp.containersList) < cp.minContainers {
+		t.Errorf("recycleExpiredContainers() dropped the pool below minContainers, got %d", len(cp.containersList))
+	}
+
+	// Releasing the flagged container recycles it instead of returning it to the pool
+	cp.ReleaseContainer(con3)
+	if _, ok := cp.lastUsedTime["container3"]; ok {
+		t.Errorf("ReleaseContainer() did not recycle flagged container container3")
+	}
+	for i := len(cp.availableContainers); i > 0; i-- {
+		if c := <-cp.availableContainers; c.ID == "container3" {
+			t.Errorf("ReleaseContainer() returned flagged container container3 to the pool")
+		}
+	}
+}
+
+func TestContainerPool_RefillsToMinAfterRemoval(t *testing.T) {
+	mockClient := &mockDockerClient{}
+	cp, _ := NewContainerPool(2, 5, time.Minute*10, "test/image")
+	cp.client = mockClient
+	cp.availableContainers = make(chan *DockerContainer, 5)
+
+	con1 := &DockerContainer{ID: "container1", State: Free}
+	con2 := &DockerContainer{ID: "container2", State: Free}
+	cp.containersList = []*DockerContainer{con1, con2}
+	cp.lastUsedTime = map[string]time.Time{
+		"container1": time.Now(),
+		"container2": time.Now(),
+	}
+
+	cp.mu.Lock()
+	cp.removeContainer("container1")
+	cp.mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		total := cp.Stats().Total
+		if total == cp.minContainers {
+			break
+		}
+		if total > cp.minContainers {
+			t.Fatalf("refill overshot minContainers, got %d containers", total)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool did not refill to minContainers, got %d containers", total)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(cp.availableContainers) != 1 {
+		t.Errorf("refilled container was not made available, got %d available", len(cp.availableContainers))
+	}
+}
+
+func TestContainerPool_probeFreeContainers(t *testing.T) {
+	mockClient := &mockDockerClient{}
+	cp, _ := NewContainerPool(0, 5, time.Minute*10, "test/image")
+	cp.client = mockClient
+	cp.availableContainers = make(chan *DockerContainer, 5)
+
+	healthy := &DockerContainer{
+		ID:     "container1",
+		State:  Free,
+		Stdin:  bufio.NewWriter(&mockWriteCloser{}),
+		Stdout: bufio.NewScanner(strings.NewReader(`{"type": "check_alive_output"}`)),
+	}
+	unhealthy := &DockerContainer{
+		ID:     "container2",
+		State:  Free,
+		Stdin:  bufio.NewWriter(&mockWriteCloser{}),
+		Stdout: bufio.NewScanner(strings.NewReader(`{"type": "error"}`)),
+	}
+	busy := &DockerContainer{ID: "container3", State: Busy}
+	cp.containersList = []*DockerContainer{healthy, unhealthy, busy}
+	cp.lastUsedTime = map[string]time.Time{
+		"container1": time.Now(),
+		"container2": time.Now(),
+		"container3": time.Now(),
+	}
+	cp.availableContainers <- healthy
+	cp.availableContainers <- unhealthy
+
+	cp.probeFreeContainers()
+
+	if _, ok := cp.lastUsedTime["container2"]; ok {
+		t.Errorf("probeFreeContainers() did not evict unhealthy container container2")
+	}
+	if _, ok := cp.lastUsedTime["container1"]; !ok {
+		t.Errorf("probeFreeContainers() evicted healthy container container1")
+	}
+	if _, ok := cp.lastUsedTime["container3"]; !ok {
+		t.Errorf("probeFreeContainers() evicted busy container container3")
+	}
+	if len(cp.availableContainers) != 1 {
+		t.Errorf("probeFreeContainers() left %d containers available, want 1", len(cp.availableContainers))
+	}
+}
+
+func TestContainerPool_probeFreeContainers_Timeout(t *testing.T) {
+	cp, _ := NewContainerPool(0, 5, time.Minute*10, "test/image")
+	cp.client = &mockDockerClient{}
+	cp.availableContainers = make(chan *DockerContainer, 5)
+	cp.probeTimeout = 50 * time.Millisecond
+
+	stdout := &blockingReader{unblock: make(chan struct{})}
+	defer close(stdout.unblock)
+	hanging := &DockerContainer{
+		ID:     "container1",
+		State:  Free,
+		Stdin:  bufio.NewWriter(&mockWriteCloser{}),
+		Stdout: bufio.NewScanner(stdout),
+	}
+	healthy := &DockerContainer{
+		ID:     "container2",
+		State:  Free,
+		Stdin:  bufio.NewWriter(&mockWriteCloser{}),
+		Stdout: bufio.NewScanner(strings.NewReader(`{"type": "check_alive_output"}`)),
+	}
+	cp.containersList = []*DockerContainer{hanging, healthy}
+	cp.lastUsedTime = map[string]time.Time{
+		"container1": time.Now(),
+		"container2": time.Now(),
+	}
+	cp.availableContainers <- hanging
+	cp.availableContainers <- healthy
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cp.probeFreeContainers()
+	}()
+
+	// Only the container being probed is taken out of the pool
+	time.Sleep(20 * time.Millisecond)
+	cp.mu.Lock()
+	available := len(cp.availableContainers)
+	cp.mu.Unlock()
+	if available != 1 {
+		t.Errorf("probeFreeContainers() left %d containers available while probing, want 1", available)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("probeFreeContainers() blocked on a container that never answers")
+	}
+
+	if _, ok := cp.lastUsedTime["container1"]; ok {
+		t.Errorf("probeFreeContainers() did not evict container1 after the probe timed out")
+	}
+	if len(cp.availableContainers) != 1 {
+		t.Errorf("probeFreeContainers() left %d containers available, want 1", len(cp.availableContainers))
+	}
+}
+
+// blockingReader blocks every Read until unblock is closed
+type blockingReader struct {
+	unblock chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.unblock
+	return 0, io.EOF
+}
+
+func TestContainerPool_EvictLRU(t *testing.T) {
+	mockClient := &mockDockerClient{}
+	cp, _ := NewContainerPool(2, 5, time.Minute*10, "test/image")
+	cp.client = mockClient
+	cp.availableContainers = make(chan *DockerContainer, 5)
+
+	con1 := &DockerContainer{ID: "container1", State: Free}
+	con2 := &DockerContainer{ID: "container2", State: Busy}
+	con3 := &DockerContainer{ID: "container3", State: Free}
+	cp.containersList = []*DockerContainer{con1, con2, con3}
+	cp.lastUsedTime = map[string]time.Time{
+		"container1": time.Now().Add(-time.Minute * 2),
+		"container2": time.Now().Add(-time.Minute * 9),
+		"container3": time.Now().Add(-time.Minute * 5),
+	}
+	cp.availableContainers <- con1
+	cp.availableContainers <- con3
+
+	if err := cp.EvictLRU(); err != nil {
+		t.Fatalf("EvictLRU() unexpected error = %v", err)
+	}
+
+	// container2 is older but busy, so container3 is the oldest free container
+	if _, ok := cp.lastUsedTime["container3"]; ok {
+		t.Errorf("EvictLRU() did not evict the oldest free container container3")
+	}
+	if _, ok := cp.lastUsedTime["container2"]; !ok {
+		t.Errorf("EvictLRU() evicted busy container container2")
+	}
+	if _, ok := cp.lastUsedTime["container1"]; !ok {
+		t.Errorf("EvictLRU() evicted recently used container container1")
+	}
+	if len(cp.containersList) != 2 {
+		t.Errorf("EvictLRU() expected 2 containers, got %d", len(cp.containersList))
+	}
+	if len(cp.availableContainers) != 1 {
+		t.Errorf("EvictLRU() left evicted container in available containers channel")
+	}
+}
+
+func TestContainerPool_EvictLRU_NoFreeContainer(t *testing.T) {
+	cp, _ := NewContainerPool(2, 5, time.Minute*10, "test/image")
+	cp.containersList = []*DockerContainer{{ID: "container1", State: Busy}}
+	cp.lastUsedTime = map[string]time.Time{"container1": time.Now()}
+
+	if err := cp.EvictLRU(); err == nil {
+		t.Errorf("EvictLRU() expected error when no free container exists")
+	}
+}
+
+func TestContainerPool_EvictLRU_SkipsTakenContainer(t *testing.T) {
+	mockClient := &mockDockerClient{}
+	cp, _ := NewContainerPool(1, 5, time.Minute*10, "test/image")
+	cp.client = mockClient
+	cp.availableContainers = make(chan *DockerContainer, 5)
+
+	// container1 is still Free but a getter has already taken it off the channel
+	con1 := &DockerContainer{ID: "container1", State: Free}
+	con2 := &DockerContainer{ID: "container2", State: Free}
+	cp.containersList = []*DockerContainer{con1, con2}
+	cp.lastUsedTime = map[string]time.Time{
+		"container1": time.Now().Add(-time.Minute * 5),
+		"container2": time.Now().Add(-time.Minute * 2),
+	}
+	cp.availableContainers <- con2
+
+	if err := cp.EvictLRU(); err != nil {
+		t.Fatalf("EvictLRU() unexpected error = %v", err)
+	}
+
+	if _, ok := cp.lastUsedTime["container1"]; !ok {
+		t.Errorf("EvictLRU() evicted container1 which a getter had already taken")
+	}
+	if _, ok := cp.lastUsedTime["container2"]; ok {
+		t.Errorf("EvictLRU() did not evict the next oldest free container container2")
+	}
+
+	// With only the taken container left there is nothing to evict
+	cp.containersList = []*DockerContainer{con1}
+	if err := cp.EvictLRU(); err == nil {
+		t.Errorf("EvictLRU() expected error when the only free container is taken")
+	}
+	if len(cp.containersList) != 1 {
+		t.Errorf("EvictLRU() removed a taken container")
+	}
+}
+
+func TestContainerPool_GetContainerForTenant_Fair(t *testing.T) {
+	mockClient := &mockDockerClient{aliveStatus: []bool{true, true, true, true}}
+	cp, _ := NewContainerPool(1, 1, time.Minute*10, "test/image")
+	cp.client = mockClient
+	cp.fairAcquire = true
+	cp.availableContainers = make(chan *DockerContainer, 1)
+
+	con := &DockerContainer{ID: "container1", State: Busy}
+	cp.containersList = []*DockerContainer{con}
+	cp.lastUsedTime = map[string]time.Time{"container1": time.Now()}
+
+	type acquired struct {
+		tenant string
+		con    *DockerContainer
+	}
+	results := make(chan acquired, 4)
+	waitFor := func(tenant string, queued int) {
+		go func() {
+			c, err := cp.GetContainerForTenant(context.Background(), tenant)
+			if err != nil {
+				t.Errorf("GetContainerForTenant(%s) unexpected error: %v", tenant, err)
+				return
+			}
+			results <- acquired{tenant, c}
+		}()
+		deadline := time.Now().Add(time.Second)
+		for {
+			cp.mu.Lock()
+			n := len(cp.tenantWaiters[tenant])
+			cp.mu.Unlock()
+			if n == queued {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("waiter for tenant %s was not queued", tenant)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Tenant A bursts three gets before tenant B asks for one
+	waitFor("A", 1)
+	waitFor("A", 2)
+	waitFor("A", 3)
+	waitFor("B", 1)
+
+	var order []string
+	for i := 0; i < 2; i++ {
+		cp.ReleaseContainer(con)
+		select {
+		case r := <-results:
+			order = append(order, r.tenant)
+			con = r.con
+		case <-time.After(time.Second):
+			t.Fatalf("released container was not handed to a waiter")
+		}
+	}
+
+	if order[0] != "A" || order[1] != "B" {
+		t.Errorf("GetContainerForTenant() served tenants in order %v, want [A B]", order)
+	}
+}
+
+func TestContainerPool_GetContainerContext_FairWithTenants(t *testing.T) {
+	mockClient := &mockDockerClient{aliveStatus: []bool{true, true, true}}
+	cp, _ := NewContainerPool(1, 1, time.Minute*10, "test/image")
+	cp.client = mockClient
+	cp.fairAcquire = true
+	cp.availableContainers = make(chan *DockerContainer, 1)
+
+	con := &DockerContainer{ID: "container1", State: Busy}
+	cp.containersList = []*DockerContainer{con}
+	cp.lastUsedTime = map[string]time.Time{"container1": time.Now()}
+
+	results := make(chan string, 3)
+	get := func(tenant string) {
+		go func() {
+			var err error
+			if tenant == "" {
+				_, err = cp.GetContainerContext(context.Background())
+			} else {
+				_, err = cp.GetContainerForTenant(context.Background(), tenant)
+			}
+			if err != nil {
+				t.Errorf("get for tenant %q unexpected error: %v", tenant, err)
+				return
+			}
+			results <- tenant
+		}()
+	}
+	waitQueued := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for {
+			cp.mu.Lock()
+			queued := 0
+			for _, waiters := range cp.tenantWaiters {
+				queued += len(waiters)
+			}
+			cp.mu.Unlock()
+			if queued == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d queued waiters, have %d", n, queued)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// A plain caller queued behind a tenant burst is served after the first tenant get
+	get("A")
+	waitQueued(1)
+	get("A")
+	waitQueued(2)
+	get("")
+	waitQueued(3)
+
+	var order []string
+	for i := 0; i < 2; i++ {
+		cp.ReleaseContainer(con)
+		select {
+		case tenant := <-results:
+			order = append(order, tenant)
+		case <-time.After(time.Second):
+			t.Fatalf("released container was not handed to a waiter")
+		}
+	}
+
+	if order[0] != "A" || order[1] != "" {
+		t.Errorf("containers were handed out in order %q, want [A \"\"]", order)
+	}
+}
+
+func TestContainerPool_Shutdown(t *testing.T) {
+	mockClient := &mockDockerClient{}
+	cp, _ := NewContainerPool(2, 5, time.Minute*10, "test/image")
+	cp.client = mockClient
+	cp.availableContainers = make(chan *DockerContainer, 5)
+
+	con1 := &DockerContainer{ID: "container1", State: Free}
+	con2 := &DockerContainer{ID: "container2", State: Busy}
+	cp.containersList = []*DockerContainer{con1, con2}
+	cp.lastUsedTime = map[string]time.Time{
+		"container1": time.Now(),
+		"container2": time.Now(),
+	}
+	cp.availableContainers <- con1
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cp.ReleaseContainer(con2)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := cp.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() unexpected error: %v", err)
+	}
+
+	if len(cp.containersList) != 0 {
+		t.Errorf("Shutdown() left %d containers in the pool", len(cp.containersList))
+	}
+	if len(cp.availableContainers) != 0 {
+		t.Errorf("Shutdown() left %d containers available", len(cp.availableContainers))
+	}
+	if con, err := cp.GetContainerContext(context.Background()); err != ErrPoolClosed {
+		t.Errorf("GetContainerContext() after Shutdown = %v, %v, want ErrPoolClosed", con, err)
+	}
+}
+
+func TestContainerPool_Shutdown_RacingGet(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		cp, _ := NewContainerPool(0, 5, time.Minute*10, "test/image")
+		cp.client = &mockDockerClient{}
+		cp.availableContainers = make(chan *DockerContainer, 5)
+		cp.containersList = nil
+		cp.lastUsedTime = map[string]time.Time{}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cp.GetContainerContext(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			cp.Shutdown(ctx)
+		}()
+		wg.Wait()
+
+		cp.mu.Lock()
+		remaining := len(cp.containersList)
+		cp.mu.Unlock()
+		if remaining != 0 {
+			t.Fatalf("iteration %d: %d containers registered after Shutdown", i, remaining)
+		}
+	}
+}
+
+func TestContainerPool_Shutdown_WaitsForTakenContainer(t *testing.T) {
+	cp, _ := NewContainerPool(0, 5, time.Minute*10, "test/image")
+	cp.client = &mockDockerClient{}
+	cp.availableContainers = make(chan *DockerContainer, 5)
+
+	con1 := &DockerContainer{ID: "container1", State: Free}
+	cp.containersList = []*DockerContainer{con1}
+	cp.lastUsedTime = map[string]time.Time{"container1": time.Now()}
+	cp.availableContainers <- con1
+
+	// A container taken off the channel counts as busy before it is health checked
+	con, _, err := cp.acquireContainer(context.Background(), false)
+	if err != nil || con != con1 {
+		t.Fatalf("acquireContainer() = %v, %v, want container1", con, err)
+	}
+	if busy := cp.Stats().Busy; busy != 1 {
+		t.Errorf("Stats().Busy = %d right after acquireContainer(), want 1", busy)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cp.Shutdown(ctx); err == nil {
+		t.Errorf("Shutdown() did not wait for the taken container")
+	}
+}
+
+func TestContainerPool_restoreContainers(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		wantAttached int
+	}{
+		{"Remove orphaned containers", OrphanPolicyRemove, 0},
+		{"Reattach up to maxContainers", OrphanPolicyReattach, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateFile := filepath.Join(t.TempDir(), "containers.json")
+			data, _ := json.Marshal([]string{"old1", "old2", "old3"})
+			if err := os.WriteFile(stateFile, data, 0o600); err != nil {
+				t.Fatalf("failed to write state file: %v", err)
+			}
+
+			mockClient := &mockDockerClient{}
+			cp, _ := NewContainerPool(0, 2, time.Minute*10, "test/image")
+			cp.client = mockClient
+			cp.stateFile = stateFile
+			cp.orphanPolicy = tt.policy
+
+			if err := cp.restoreContainers(); err != nil {
+				t.Fatalf("restoreContainers() unexpected error: %v", err)
+			}
+
+			if len(cp.containersList) != tt.wantAttached {
+				t.Errorf("restoreContainers() attached %d containers, want %d", len(cp.containersList), tt.wantAttached)
+			}
+			if len(cp.availableContainers) != tt.wantAttached {
+				t.Errorf("restoreContainers() made %d containers available, want %d", len(cp.availableContainers), tt.wantAttached)
+			}
+
+			var saved []string
+			data, _ = os.ReadFile(stateFile)
+			if err := json.Unmarshal(data, &saved); err != nil {
+				t.Fatalf("state file is not valid JSON: %v", err)
+			}
+			if len(saved) != tt.wantAttached {
+				t.Errorf("state file lists %d containers, want %d", len(saved), tt.wantAttached)
+			}
+		})
+	}
+}
+
+func TestContainerPool_restoreContainers_CorruptState(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "containers.json")
+	if err := os.WriteFile(stateFile, []byte(`["old1", "ol`), 0o600); err != nil {
+		t.Fatalf("failed to write state file: %v", err)
+	}
+
+	cp, _ := NewContainerPool(0, 2, time.Minute*10, "test/image")
+	cp.client = &mockDockerClient{}
+	cp.stateFile = stateFile
+	cp.orphanPolicy = OrphanPolicyReattach
+
+	if err := cp.restoreContainers(); err != nil {
+		t.Fatalf("restoreContainers() unexpected error for a corrupt state file: %v", err)
+	}
+	if len(cp.containersList) != 0 {
+		t.Errorf("restoreContainers() attached %d containers from a corrupt state file", len(cp.containersList))
+	}
+
+	// The corrupt file is replaced, and no temp files are left next to it
+	var saved []string
+	data, _ := os.ReadFile(stateFile)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("state file is not valid JSON after restore: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected only the state file in %s, found %d entries", dir, len(entries))
+	}
+}
+
+func TestContainerPool_restoreContainers_KeepsFailedRemovals(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "containers.json")
+	data, _ := json.Marshal([]string{"old1", "old2"})
+	if err := os.WriteFile(stateFile, data, 0o600); err != nil {
+		t.Fatalf("failed to write state file: %v", err)
+	}
+
+	cp, _ := NewContainerPool(0, 2, time.Minute*10, "test/image")
+	cp.client = &mockDockerClient{removeErr: errors.New("daemon unavailable")}
+	cp.stateFile = stateFile
+	cp.orphanPolicy = OrphanPolicyRemove
+
+	if err := cp.restoreContainers(); err != nil {
+		t.Fatalf("restoreContainers() unexpected error: %v", err)
+	}
+
+	var saved []string
+	data, _ = os.ReadFile(stateFile)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("state file is not valid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(saved, []string{"old1", "old2"}) {
+		t.Errorf("state file lists %v, want the containers that could not be removed", saved)
+	}
+}
+
+func TestContainerPool_Stats(t *testing.T) {
+	mockClient := &mockDockerClient{}
+	cp, _ := NewContainerPool(2, 5, time.Minute*10, "test/image")
+	cp.client = mockClient
+
+	before := cp.Stats()
+	if before.Total != 2 || before.Free != 2 || before.Busy != 0 {
+		t.Errorf("Stats() = %+v, want 2 total and 2 free", before)
+	}
+
+	mockClient.aliveStatus = []bool{true}
+	con := cp.GetContainer()
+	if con == nil {
+		t.Fatal("GetContainer() returned nil")
+	}
+
+	after := cp.Stats()
+	if after.Busy != 1 || after.Free != 1 {
+		t.Errorf("Stats() = %+v, want 1 busy and 1 free", after)
+	}
+	if after.GetsReused != before.GetsReused+1 {
+		t.Errorf("Stats() GetsReused = %d, want %d", after.GetsReused, before.GetsReused+1)
+	}
+
+	cp.mu.Lock()
+	cp.removeContainer(con.ID)
+	cp.mu.Unlock()
+	if removed := cp.Stats().Removed; removed != before.Removed+1 {
+		t.Errorf("Stats() Removed = %d, want %d", removed, before.Removed+1)
+	}
+}
+
+func TestContainerPool_Stats_ConcurrentRelease(t *testing.T) {
+	cp, _ := NewContainerPool(0, 10, time.Minute*10, "test/image")
+	cp.client = &mockDockerClient{}
+	cp.availableContainers = make(chan *DockerContainer, 10)
+
+	var busy []*DockerContainer
+	for i := 0; i < 10; i++ {
+		busy = append(busy, &DockerContainer{ID: "container" + string(rune('0'+i)), State: Busy})
+	}
+	cp.containersList = busy
+
+	// Run with -race: State must only change under cp.mu
+	var wg sync.WaitGroup
+	for _, con := range busy {
+		wg.Add(1)
+		go func(con *DockerContainer) {
+			defer wg.Done()
+			cp.ReleaseContainer(con)
+		}(con)
+	}
+	for i := 0; i < 10; i++ {
+		cp.Stats()
+	}
+	wg.Wait()
+
+	if stats := cp.Stats(); stats.Busy != 0 || stats.Free != 10 {
+		t.Errorf("Stats() = %+v, want 10 free after every release", stats)
+	}
+}
+
+func TestTenantContainerPool_IsolatesTenants(t *testing.T) {
+	mockClient := &mockDockerClient{aliveStatus: []bool{true, true}}
+	tp, _ := NewTenantContainerPool(TenantPoolLimits{MinContainers: 1, MaxContainers: 1}, 0, 0, time.Minute*10, "test/image")
+	tp.newPool = func(stateFile string, minSize, maxSize int) (*ContainerPool, error) {
+		cp, err := NewContainerPoolWithStateFile(minSize, maxSize, time.Minute*10, "test/image", stateFile)
+		if err != nil {
+			return nil, err
+		}
+		cp.client = mockClient
+		return cp, nil
+	}
+
+	conA, err := tp.GetContainerContext(context.Background(), "A")
+	if err != nil {
+		t.Fatalf("GetContainerContext(A) unexpected error: %v", err)
+	}
+
+	// Tenant A is at its max, a second request must wait instead of taking B's container
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if con, err := tp.GetContainerContext(ctx, "A"); err == nil {
+		t.Errorf("GetContainerContext(A) expected error when tenant pool is exhausted, got container %v", con)
+	}
+
+	if _, err := tp.GetContainerContext(context.Background(), "B"); err != nil {
+		t.Errorf("GetContainerContext(B) unexpected error while tenant A is saturated: %v", err)
+	}
+
+	tp.ReleaseContainer(conA)
+	if _, err := tp.GetContainerContext(context.Background(), "A"); err != nil {
+		t.Errorf("GetContainerContext(A) unexpected error after release: %v", err)
+	}
+}
+
+// newMockTenantPool returns a TenantContainerPool whose sub-pools and overflow pool use mockClient
+func newMockTenantPool(limits TenantPoolLimits, overflowSize, overflowCap int, mockClient *mockDockerClient) *TenantContainerPool {
+	tp, _ := NewTenantContainerPool(limits, 0, overflowCap, time.Minute*10, "test/image")
+	tp.newPool = func(stateFile string, minSize, maxSize int) (*ContainerPool, error) {
+		cp, err := NewContainerPoolWithStateFile(minSize, maxSize, time.Minute*10, "test/image", stateFile)
+		if err != nil {
+			return nil, err
+		}
+		cp.client = mockClient
+		return cp, nil
+	}
+	if overflowSize > 0 {
+		tp.overflow, _ = tp.newPool(tp.poolStateFile("overflow"), 0, overflowSize)
+	}
+	return tp
+}
+
+func TestTenantContainerPool_SeparateStateFiles(t *testing.T) {
+	mockClient := &mockDockerClient{aliveStatus: []bool{true, true}}
+	tp := newMockTenantPool(TenantPoolLimits{MinContainers: 1, MaxContainers: 1}, 0, 0, mockClient)
+	tp.stateFile = filepath.Join(t.TempDir(), "containers.json")
+	tp.overflow, _ = tp.newPool(tp.poolStateFile("overflow"), 0, 1)
+
+	for _, tenant := range []string{"A", "B"} {
+		if _, err := tp.GetContainerContext(context.Background(), tenant); err != nil {
+			t.Fatalf("GetContainerContext(%s) unexpected error: %v", tenant, err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, pool := range []*ContainerPool{tp.pools["A"].pool, tp.pools["B"].pool, tp.overflow} {
+		if pool.stateFile == "" || seen[pool.stateFile] {
+			t.Errorf("pool state file %q is empty or shared with another pool", pool.stateFile)
+		}
+		seen[pool.stateFile] = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	tp.Shutdown(ctx)
+}
+
+func TestTenantContainerPool_GlobalOverflowCap(t *testing.T) {
+	mockClient := &mockDockerClient{aliveStatus: []bool{true, true, true, true}}
+	tp := newMockTenantPool(TenantPoolLimits{MinContainers: 1, MaxContainers: 1}, 2, 1, mockClient)
+
+	for _, tenant := range []string{"A", "A", "B"} {
+		if _, err := tp.GetContainerContext(context.Background(), tenant); err != nil {
+			t.Fatalf("GetContainerContext(%s) unexpected error: %v", tenant, err)
+		}
+	}
+
+	// A holds the only overflow slot, so B must wait on its own sub-pool even though the
+	// overflow pool has room for another container
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if con, err := tp.GetContainerContext(ctx, "B"); err == nil {
+		t.Errorf("GetContainerContext(B) expected error once the global overflow cap is reached, got container %v", con)
+	}
+	if tp.overflowInUse != 1 {
+		t.Errorf("expected 1 overflow container in use, got %d", tp.overflowInUse)
+	}
+}
+
+func TestTenantContainerPool_CreatesSubPoolsOutsideLock(t *testing.T) {
+	mockClient := &mockDockerClient{aliveStatus: []bool{true, true}}
+	tp := newMockTenantPool(TenantPoolLimits{MinContainers: 1, MaxContainers: 1}, 0, 0, mockClient)
+
+	newPool := tp.newPool
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	var calls int32
+	tp.newPool = func(stateFile string, minSize, maxSize int) (*ContainerPool, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(entered)
+			<-unblock
+		}
+		return newPool(stateFile, minSize, maxSize)
+	}
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := tp.GetContainerContext(context.Background(), "A")
+		slow <- err
+	}()
+	<-entered
+
+	// Tenant A's pool is still being created, tenant B must not wait for it
+	done := make(chan error, 1)
+	go func() {
+		_, err := tp.GetContainerContext(context.Background(), "B")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("GetContainerContext(B) unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetContainerContext(B) blocked behind tenant A's pool creation")
+	}
+
+	close(unblock)
+	if err := <-slow; err != nil {
+		t.Errorf("GetContainerContext(A) unexpected error: %v", err)
+	}
+}
+
+func TestTenantContainerPool_Shutdown(t *testing.T) {
+	mockClient := &mockDockerClient{aliveStatus: []bool{true, true, true}}
+	tp := newMockTenantPool(TenantPoolLimits{MinContainers: 1, MaxContainers: 1}, 1, 1, mockClient)
+
+	var held []*DockerContainer
+	for _, tenant := range []string{"A", "A", "B"} {
+		con, err := tp.GetContainerContext(context.Background(), tenant)
+		if err != nil {
+			t.Fatalf("GetContainerContext(%s) unexpected error: %v", tenant, err)
+		}
+		held = append(held, con)
+	}
+	for _, con := range held {
+		tp.ReleaseContainer(con)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tp.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() unexpected error: %v", err)
+	}
+
+	pools := []*ContainerPool{tp.overflow}
+	for _, entry := range tp.pools {
+		pools = append(pools, entry.pool)
+	}
+	for _, pool := range pools {
+		if !pool.closed || len(pool.containersList) != 0 {
+			t.Errorf("Shutdown() left a pool open with %d containers", len(pool.containersList))
+		}
+	}
+	if _, err := tp.GetContainerContext(context.Background(), "C"); err != ErrPoolClosed {
+		t.Errorf("GetContainerContext() after Shutdown error = %v, want ErrPoolClosed", err)
+	}
+	if err := tp.Shutdown(ctx); err != ErrPoolClosed {
+		t.Errorf("second Shutdown() error = %v, want ErrPoolClosed", err)
+	}
+}
+
 // Mock Docker client
 type mockDockerClient struct {
 	aliveStatus []bool
+	removeErr   error
 	client.Client
 }
 
@@ -227,7 +1204,7 @@ func (m *mockDockerClient) ContainerAttach(ctx context.Context, container string
 }
 
 func (m *mockDockerClient) ContainerRemove(ctx context.Context, container string, options container.RemoveOptions) error {
-	return nil
+	return m.removeErr
 }
 
 func (m *mockDockerClient) Close() error {
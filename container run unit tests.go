@@ -0,0 +1,384 @@
+package container
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"your-project/output"
+)
+
+func TestParseJobContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		context string
+		want    JobContext
+		wantErr error
+	}{
+		{
+			name:    "Valid context",
+			context: `{"job_id": "job1", "tenant": "tenant1", "command": "fetch"}`,
+			want: JobContext{
+				JobID:  "job1",
+				Tenant: "tenant1",
+				Raw: map[string]interface{}{
+					"job_id":  "job1",
+					"tenant":  "tenant1",
+					"command": "fetch",
+				},
+			},
+		},
+		{
+			name:    "Context with timeout",
+			context: `{"job_id": "job1", "tenant": "tenant1", "timeout": 1.5}`,
+			want: JobContext{
+				JobID:   "job1",
+				Tenant:  "tenant1",
+				Timeout: 1500 * time.Millisecond,
+				Raw: map[string]interface{}{
+					"job_id":  "job1",
+					"tenant":  "tenant1",
+					"timeout": 1.5,
+				},
+			},
+		},
+		{
+			name:    "Missing job_id",
+			context: `{"tenant": "tenant1"}`,
+			wantErr: ErrMissingJobField,
+		},
+		{
+			name:    "Empty tenant",
+			context: `{"job_id": "job1", "tenant": ""}`,
+			wantErr: ErrMissingJobField,
+		},
+		{
+			name:    "Non-string job_id",
+			context: `{"job_id": 1, "tenant": "tenant1"}`,
+			wantErr: ErrMissingJobField,
+		},
+		{
+			name:    "Invalid JSON",
+			context: `{"job_id": `,
+			wantErr: ErrInvalidJobContext,
+		},
+		{
+			name:    "Null context",
+			context: `null`,
+			wantErr: ErrInvalidJobContext,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseJobContext(tt.context)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("ParseJobContext() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseJobContext() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseJobContext() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobContext_Decode(t *testing.T) {
+	jobCtx, err := ParseJobContext(`{"job_id": "job1", "tenant": "tenant1", "script": "fetch.py"}`)
+	if err != nil {
+		t.Fatalf("ParseJobContext() unexpected error: %v", err)
+	}
+
+	var job struct {
+		JobID  string `json:"job_id"`
+		Tenant string `json:"tenant"`
+		Script string `json:"script"`
+	}
+	if err := jobCtx.Decode(&job); err != nil {
+		t.Fatalf("Decode() unexpected error: %v", err)
+	}
+	if job.JobID != "job1" || job.Tenant != "tenant1" || job.Script != "fetch.py" {
+		t.Errorf("Decode() = %+v", job)
+	}
+
+	var wrongShape struct {
+		JobID int `json:"job_id"`
+	}
+	if err := jobCtx.Decode(&wrongShape); !errors.Is(err, ErrInvalidJobContext) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrInvalidJobContext)
+	}
+}
+
+func TestContainer_handleResultOutput_AccumulatesFetchedData(t *testing.T) {
+	tests := []struct {
+		name    string
+		outputs []interface{}
+		want    interface{}
+	}{
+		{
+			name: "Slices are appended in order",
+			outputs: []interface{}{
+				[]interface{}{"data1"},
+				[]interface{}{"data2", "data3"},
+				[]interface{}{"data4"},
+			},
+			want: []interface{}{"data1", "data2", "data3", "data4"},
+		},
+		{
+			name: "Maps are deep-merged",
+			outputs: []interface{}{
+				map[string]interface{}{
+					"alerts": []interface{}{"alert1"},
+					"meta":   map[string]interface{}{"page": 1.0, "source": "api"},
+				},
+				map[string]interface{}{
+					"alerts": []interface{}{"alert2"},
+					"meta":   map[string]interface{}{"page": 2.0},
+					"total":  2.0,
+				},
+			},
+			want: map[string]interface{}{
+				"alerts": []interface{}{"alert1", "alert2"},
+				"meta":   map[string]interface{}{"page": 2.0, "source": "api"},
+				"total":  2.0,
+			},
+		},
+		{
+			name: "Mismatched types are replaced",
+			outputs: []interface{}{
+				[]interface{}{"data1"},
+				map[string]interface{}{"key1": "value1"},
+			},
+			want: map[string]interface{}{"key1": "value1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{}
+			result := c.initializeDefaultResult()
+			for _, fetchedData := range tt.outputs {
+				result = c.handleResultOutput(OutputContainer{
+					Type:        "result",
+					ResultsType: "json",
+					Results:     map[string]interface{}{"fetched_data": fetchedData},
+				}, result)
+			}
+
+			got := result["Contents"].(map[string]interface{})["fetched_data"]
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fetched_data = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainer_processContainerOutput_RawLines(t *testing.T) {
+	stdout := strings.Join([]string{
+		`starting script`,
+		`{"type": "log", "message": "fetching alerts"}`,
+		`debug: 2 alerts`,
+		`{"type": "result", "results_type": "json", "results": {"alerts": 2}}`,
+	}, "\n")
+	c := &Container{
+		Stdout:  bufio.NewScanner(strings.NewReader(stdout)),
+		LogChan: make(chan map[string]interface{}, 10),
+	}
+	jobCtx := JobContext{JobID: "job1", Tenant: "tenant1"}
+
+	outputResult, err := c.processContainerOutput(c.Stdout, nil, zap.NewNop(), jobCtx, c.initializeDefaultResult())
+	if err != nil {
+		t.Fatalf("processContainerOutput() unexpected error: %v", err)
+	}
+	close(c.LogChan)
+
+	var logs []map[string]interface{}
+	for log := range c.LogChan {
+		logs = append(logs, log)
+	}
+	want := []map[string]interface{}{
+		{"Type": 4, "Contents": "starting script", "JobID": "job1", "Tenant": "tenant1", "Raw": true},
+		{"Type": 4, "Contents": "fetching alerts", "JobID": "job1", "Tenant": "tenant1"},
+		{"Type": 4, "Contents": "debug: 2 alerts", "JobID": "job1", "Tenant": "tenant1", "Raw": true},
+	}
+	if !reflect.DeepEqual(logs, want) {
+		t.Errorf("logs = %v, want %v", logs, want)
+	}
+
+	wantResult := map[string]interface{}{
+		"Type":           1,
+		"Contents":       map[string]interface{}{"alerts": 2.0},
+		"ContentsFormat": "json",
+	}
+	if !reflect.DeepEqual(outputResult, wantResult) {
+		t.Errorf("outputResult = %v, want %v", outputResult, wantResult)
+	}
+}
+
+func TestContainer_Run_Timeout(t *testing.T) {
+	// stdout keeps logging and never emits "completed", and nobody reads the log channel
+	stdout := &endlessLogReader{}
+	c := &Container{
+		Stdout:  bufio.NewScanner(stdout),
+		LogChan: make(chan map[string]interface{}, 10),
+	}
+
+	done := make(chan struct{})
+	var got output.Output
+	var err error
+	go func() {
+		defer close(done)
+		got, err = c.Run("script", `{"job_id": "job1", "tenant": "tenant1", "timeout": 0.05}`, nil, "request1", "task1")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not time out")
+	}
+
+	if err != nil {
+		t.Fatalf("Run() unexpected error: %v", err)
+	}
+	want := CreateContainerErrorOutput("script", nil, "request1", "task1", fmt.Errorf("%w after %s", ErrRunTimeout, 50*time.Millisecond))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Run() = %v, want %v", got, want)
+	}
+
+	// The scan loop must have exited before Run returned
+	reads := stdout.count()
+	for len(c.LogChan) > 0 {
+		<-c.LogChan
+	}
+	time.Sleep(50 * time.Millisecond)
+	if stdout.count() != reads || len(c.LogChan) != 0 {
+		t.Errorf("Run() left the output loop running after the timeout")
+	}
+}
+
+// endlessLogReader returns a log message on every Read
+type endlessLogReader struct {
+	mu    sync.Mutex
+	reads int
+}
+
+func (r *endlessLogReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	r.reads++
+	r.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	return copy(p, "{\"type\": \"log\", \"message\": \"working\"}\n"), nil
+}
+
+func (r *endlessLogReader) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reads
+}
+
+func TestContainer_Run_TimeoutBlockedOutput(t *testing.T) {
+	defer func(grace time.Duration) { stopGracePeriod = grace }(stopGracePeriod)
+	stopGracePeriod = 50 * time.Millisecond
+
+	stdout := &blockingReader{unblock: make(chan struct{})}
+	defer close(stdout.unblock)
+	c := &Container{
+		Stdout:  bufio.NewScanner(stdout),
+		LogChan: make(chan map[string]interface{}, 10),
+	}
+
+	done := make(chan struct{})
+	var got output.Output
+	var err error
+	go func() {
+		defer close(done)
+		got, err = c.Run("script", `{"job_id": "job1", "tenant": "tenant1", "timeout": 0.05}`, nil, "request1", "task1")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() blocked on output that never closes")
+	}
+
+	if err != nil {
+		t.Fatalf("Run() unexpected error: %v", err)
+	}
+	wantErr := fmt.Errorf("%w after %s, output did not close within %s of stopping the container", ErrRunTimeout, 50*time.Millisecond, 50*time.Millisecond)
+	want := CreateContainerErrorOutput("script", nil, "request1", "task1", wantErr)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Run() = %v, want %v", got, want)
+	}
+}
+
+// blockingReader blocks every Read until unblock is closed and never returns data
+type blockingReader struct {
+	unblock chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.unblock
+	return 0, io.EOF
+}
+
+func TestContainer_Run_InvalidContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		context string
+	}{
+		{
+			name:    "No job_id",
+			context: `{"tenant": "tenant1"}`,
+		},
+		{
+			name:    "No tenant",
+			context: `{"job_id": "job1"}`,
+		},
+		{
+			name:    "Empty job_id",
+			context: `{"job_id": "", "tenant": "tenant1"}`,
+		},
+		{
+			name:    "Malformed JSON",
+			context: `{"job_id": "job1", "tenant"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{
+				Status:  1,
+				Stdout:  bufio.NewScanner(strings.NewReader(`{"type": "log", "message": "should not be read"}`)),
+				LogChan: make(chan map[string]interface{}, 10),
+			}
+
+			got, err := c.Run("script", tt.context, nil, "request1", "task1")
+			if err != nil {
+				t.Fatalf("Run() unexpected error: %v", err)
+			}
+
+			_, parseErr := ParseJobContext(tt.context)
+			want := CreateContainerErrorOutput("script", nil, "request1", "task1", parseErr)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Run() = %v, want %v", got, want)
+			}
+			// The container must not have been started, written to or read from
+			if c.Cmd != nil || len(c.LogChan) != 0 {
+				t.Errorf("Run() used the container for an invalid context")
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/viper"
+)
+
+func TestContainerPool_createContainer_ResourceLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		memory     int64
+		cpuShares  int64
+		wantMemory int64
+		wantShares int64
+	}{
+		{"Unset limits", 0, 0, 0, 0},
+		{"Memory and CPU limits", 512 * 1024 * 1024, 256, 512 * 1024 * 1024, 256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			if tt.memory != 0 {
+				viper.Set("worker.container_memory_limit", tt.memory)
+			}
+			if tt.cpuShares != 0 {
+				viper.Set("worker.container_cpu_shares", tt.cpuShares)
+			}
+
+			mockClient := &captureDockerClient{}
+			pool := &ContainerPool{
+				client:     mockClient,
+				maxSize:    1,
+				containers: make(map[string]*ContainerInfo),
+				freePool:   make(chan string, 1),
+			}
+
+			if err := pool.createContainer("test", "tenant1"); err != nil {
+				t.Fatalf("createContainer() unexpected error: %v", err)
+			}
+
+			if mockClient.hostConfig == nil {
+				t.Fatal("createContainer() did not pass a HostConfig")
+			}
+			if got := mockClient.hostConfig.Resources.Memory; got != tt.wantMemory {
+				t.Errorf("HostConfig.Resources.Memory = %d, want %d", got, tt.wantMemory)
+			}
+			if got := mockClient.hostConfig.Resources.CPUShares; got != tt.wantShares {
+				t.Errorf("HostConfig.Resources.CPUShares = %d, want %d", got, tt.wantShares)
+			}
+		})
+	}
+}
+
+func TestContainerPool_createContainersForTenant_GlobalCap(t *testing.T) {
+	viper.Reset()
+	viper.Set("worker.numberOfInstances", 2)
+
+	mockClient := &captureDockerClient{}
+	pool := &ContainerPool{
+		client:           mockClient,
+		maxSize:          3,
+		containers:       make(map[string]*ContainerInfo),
+		freePool:         make(chan string, 3),
+		processedTenants: make(map[string]bool),
+	}
+
+	for _, tenant := range []string{"tenant1", "tenant2", "tenant3"} {
+		pool.createContainersForTenant(tenant)
+	}
+
+	if len(pool.containers) != 3 {
+		t.Errorf("createContainersForTenant() created %d containers, want 3", len(pool.containers))
+	}
+	if mockClient.created != 3 {
+		t.Errorf("ContainerCreate called %d times, want 3", mockClient.created)
+	}
+	if err := pool.createContainer("extra", "tenant4"); err == nil {
+		t.Errorf("createContainer() expected error once the pool is at maxSize")
+	}
+}
+
+// captureDockerClient records the HostConfig passed to ContainerCreate
+type captureDockerClient struct {
+	hostConfig *container.HostConfig
+	created    int
+	client.Client
+}
+
+func (m *captureDockerClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+	m.hostConfig = hostConfig
+	m.created++
+	return container.ContainerCreateCreatedBody{ID: fmt.Sprintf("test-container-%d", m.created)}, nil
+}
+
+func (m *captureDockerClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	return nil
+}
@@ -20,6 +20,9 @@ type ContainerPool struct {
 	maxSize      int
 	freePool     chan string
 	processedTenants map[string]bool
+
+	// pending counts containers being created, so maxSize holds across concurrent tenants
+	pending int
 }
 
 // ... (previous ContainerInfo struct and other methods remain the same)
@@ -64,6 +67,15 @@ func (p *ContainerPool) createContainersForTenant(tenant string) {
 }
 
 func (p *ContainerPool) createContainer(name, tenant string) error {
+	if !p.reserveSlot() {
+		return fmt.Errorf("container pool is at its maximum of %d containers", p.maxSize)
+	}
+	defer func() {
+		p.mutex.Lock()
+		p.pending--
+		p.mutex.Unlock()
+	}()
+
 	ctx := context.Background()
 	
 	// You may want to customize this configuration based on your needs
@@ -72,7 +84,9 @@ func (p *ContainerPool) createContainer(name, tenant string) error {
 		Env: []string{fmt.Sprintf("TENANT=%s", tenant)},
 	}
 	
-	hostConfig := &container.HostConfig{}
+	hostConfig := &container.HostConfig{
+		Resources: containerResources(),
+	}
 	
 	resp, err := p.client.ContainerCreate(ctx, config, hostConfig, nil, nil, name)
 	if err != nil {
@@ -95,6 +109,27 @@ func (p *ContainerPool) createContainer(name, tenant string) error {
 	return nil
 }
 
+// reserveSlot claims room for one more container, counting containers still being created
+func (p *ContainerPool) reserveSlot() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.containers)+p.pending >= p.maxSize {
+		return false
+	}
+	p.pending++
+	return true
+}
+
+// containerResources reads the per-container limits from config. Unset values are left
+// at zero, which Docker treats as unlimited.
+func containerResources() container.Resources {
+	return container.Resources{
+		Memory:    viper.GetInt64("worker.container_memory_limit"),
+		CPUShares: viper.GetInt64("worker.container_cpu_shares"),
+	}
+}
+
 func main() {
 	// Initialize viper configuration
 	viper.SetConfigName("config")
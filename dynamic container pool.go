@@ -4,7 +4,11 @@ import (
 	"bufio"
 	"context"
 	"datafeedctl/internal/app/logz"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -14,6 +18,22 @@ import (
 	"github.com/spf13/viper"
 )
 
+const defaultAcquireAttempts = 3
+
+const defaultProbeTimeout = 5 * time.Second
+
+// Policies for containers left over from a previous run, set with worker.orphan_container_policy
+const (
+	OrphanPolicyRemove   = "remove"
+	OrphanPolicyReattach = "reattach"
+)
+
+// ErrPoolExhausted is returned by TryGetContainer when no container can be handed out
+var ErrPoolExhausted = errors.New("container pool exhausted")
+
+// ErrPoolClosed is returned by GetContainerContext after Shutdown
+var ErrPoolClosed = errors.New("container pool is shut down")
+
 type ContainerPool struct {
 	containersList      []*DockerContainer
 	availableContainers chan *DockerContainer
@@ -25,6 +45,59 @@ type ContainerPool struct {
 	maxContainers      int
 	idleTimeout        time.Duration
 	lastUsedTime       map[string]time.Time
+
+	// maxLifetime recycles containers older than this even when they are not idle, zero disables it
+	maxLifetime      time.Duration
+	createdTime      map[string]time.Time
+	recycleOnRelease map[string]bool
+
+	// maxAcquireAttempts bounds how many dead containers GetContainer replaces before failing
+	maxAcquireAttempts int
+
+	// reconcile wakes the background refill after a removal
+	reconcile chan struct{}
+
+	// probeInterval is how often free containers are health checked, zero disables it.
+	// A container that does not answer within probeTimeout counts as unhealthy.
+	probeInterval time.Duration
+	probeTimeout  time.Duration
+
+	// stateFile persists the IDs of created containers so a restart can find them, empty
+	// disables it. Writes happen on persistLoop, outside mu, and bursts of changes are
+	// coalesced into one write. orphans are IDs from a previous run whose removal failed,
+	// they stay in the file so the next start tries again.
+	stateFile    string
+	orphanPolicy string
+	orphans      []string
+	persist      chan struct{}
+	stateMu      sync.Mutex
+
+	// done stops the background goroutines once Shutdown is called
+	done   chan struct{}
+	closed bool
+
+	// fairAcquire serves GetContainerForTenant waiters round-robin across tenants.
+	// waitingTenants holds each tenant with queued waiters once, in serving order.
+	fairAcquire    bool
+	tenantWaiters  map[string][]chan *DockerContainer
+	waitingTenants []string
+
+	// Lifetime counters, guarded by mu
+	createdCount uint64
+	removedCount uint64
+	getsCreated  uint64
+	getsReused   uint64
+}
+
+// PoolStats is a point-in-time snapshot of ContainerPool usage
+type PoolStats struct {
+	Total       int    `json:"total"`
+	Free        int    `json:"free"`
+	Busy        int    `json:"busy"`
+	Created     uint64 `json:"created"`
+	Removed     uint64 `json:"removed"`
+	GetsCreated uint64 `json:"gets_created"`
+	GetsReused  uint64 `json:"gets_reused"`
 }
 
 type DockerContainer struct {
@@ -35,6 +108,13 @@ type DockerContainer struct {
 }
 
 func NewContainerPool(minSize, maxSize int, idleTimeout time.Duration, imageName string) (*ContainerPool, error) {
+	return NewContainerPoolWithStateFile(minSize, maxSize, idleTimeout, imageName, viper.GetString("worker.container_state_file"))
+}
+
+// NewContainerPoolWithStateFile creates a pool that persists its container IDs to stateFile
+// instead of worker.container_state_file. Pools running side by side in one process need
+// their own files, or they remove each other's containers on restart.
+func NewContainerPoolWithStateFile(minSize, maxSize int, idleTimeout time.Duration, imageName, stateFile string) (*ContainerPool, error) {
 	if minSize > maxSize {
 		return nil, fmt.Errorf("minimum size cannot be greater than maximum size")
 	}
@@ -53,82 +133,353 @@ func NewContainerPool(minSize, maxSize int, idleTimeout time.Duration, imageName
 		maxContainers:      maxSize,
 		idleTimeout:        idleTimeout,
 		lastUsedTime:       make(map[string]time.Time),
+		maxAcquireAttempts: viper.GetInt("worker.container_acquire_attempts"),
+		maxLifetime:        viper.GetDuration("worker.container_max_lifetime"),
+		createdTime:        make(map[string]time.Time),
+		recycleOnRelease:   make(map[string]bool),
+		reconcile:          make(chan struct{}, 1),
+		probeInterval:      viper.GetDuration("worker.container_probe_interval"),
+		probeTimeout:       viper.GetDuration("worker.container_probe_timeout"),
+		stateFile:          stateFile,
+		orphanPolicy:       viper.GetString("worker.orphan_container_policy"),
+		persist:            make(chan struct{}, 1),
+		done:               make(chan struct{}),
+		fairAcquire:        viper.GetBool("worker.tenant_fair_acquire"),
+		tenantWaiters:      make(map[string][]chan *DockerContainer),
+	}
+	if pool.maxAcquireAttempts <= 0 {
+		pool.maxAcquireAttempts = defaultAcquireAttempts
+	}
+	if pool.probeTimeout <= 0 {
+		pool.probeTimeout = defaultProbeTimeout
+	}
+
+	if err := pool.restoreContainers(); err != nil {
+		logz.Error(fmt.Sprintf("failed to restore containers from a previous run: %v", err))
 	}
 
 	// Initialize with minimum number of containers
-	for i := 0; i < minSize; i++ {
+	for i := len(pool.containersList); i < minSize; i++ {
 		con, err := pool.createContainer()
 		if err != nil {
 			pool.cleanupContainers()
 			return nil, fmt.Errorf("failed to create container: %v", err)
 		}
 		pool.availableContainers <- con
-		pool.containersList = append(pool.containersList, con)
-		pool.lastUsedTime[con.ID] = time.Now()
+		pool.addContainer(con)
 	}
 
-	// Start the cleanup goroutine
+	// Start the cleanup and refill goroutines
 	go pool.cleanupIdleContainers()
+	go pool.reconcileLoop()
+	go pool.persistLoop()
+	if pool.probeInterval > 0 {
+		go pool.healthProbeLoop()
+	}
 
 	return pool, nil
 }
 
 func (cp *ContainerPool) GetContainer() *DockerContainer {
+	con, err := cp.GetContainerContext(context.Background())
+	if err != nil {
+		logz.Error(err.Error())
+		return nil
+	}
+	return con
+}
+
+// GetContainerContext behaves like GetContainer but gives up waiting for a free container
+// once ctx is canceled or its deadline passes. With worker.tenant_fair_acquire set, callers
+// without a tenant queue together as one tenant, so they are served in turn with
+// GetContainerForTenant waiters instead of only getting containers nobody else waits for.
+func (cp *ContainerPool) GetContainerContext(ctx context.Context) (*DockerContainer, error) {
+	if cp.fairAcquire {
+		return cp.GetContainerForTenant(ctx, "")
+	}
+	return cp.getContainer(ctx, true)
+}
+
+// TryGetContainer returns ErrPoolExhausted instead of waiting when every container is
+// busy and the pool is at maxContainers.
+func (cp *ContainerPool) TryGetContainer() (*DockerContainer, error) {
+	return cp.getContainer(context.Background(), false)
+}
+
+// GetContainerForTenant behaves like GetContainerContext, but when worker.tenant_fair_acquire
+// is set and the pool is exhausted, released containers are handed to waiting tenants in
+// turn so a burst of gets from one tenant cannot starve another.
+func (cp *ContainerPool) GetContainerForTenant(ctx context.Context, tenant string) (*DockerContainer, error) {
+	if !cp.fairAcquire {
+		return cp.GetContainerContext(ctx)
+	}
+
+	con, fresh, err := cp.acquireContainer(ctx, false)
+	if err == ErrPoolExhausted {
+		con, err = cp.waitForTenant(ctx, tenant)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cp.prepareContainer(con, fresh)
+}
+
+func (cp *ContainerPool) getContainer(ctx context.Context, wait bool) (*DockerContainer, error) {
+	con, fresh, err := cp.acquireContainer(ctx, wait)
+	if err != nil {
+		return nil, err
+	}
+	return cp.prepareContainer(con, fresh)
+}
+
+// prepareContainer checks a reused container is alive, marking a replacement busy
+func (cp *ContainerPool) prepareContainer(con *DockerContainer, fresh bool) (*DockerContainer, error) {
+	// CheckContainerAlive returns nil for a live container and a replacement for a dead one.
+	// Keep checking replacements, but only up to maxAcquireAttempts times.
+	for attempt := 1; !fresh; attempt++ {
+		replacement := cp.CheckContainerAlive(con)
+		if replacement == nil {
+			break
+		}
+		if attempt >= cp.maxAcquireAttempts {
+			// The replacement is still registered in containersList, so hand it back rather
+			// than leaking a slot; the next getter checks it again
+			cp.mu.Lock()
+			cp.makeAvailable(replacement)
+			cp.mu.Unlock()
+			return nil, fmt.Errorf("no live container after %d attempts", attempt)
+		}
+		con = replacement
+	}
+
 	cp.mu.Lock()
-	currentSize := len(cp.containersList)
+	con.State = Busy
+	cp.lastUsedTime[con.ID] = time.Now()
+	if fresh {
+		cp.getsCreated++
+	} else {
+		cp.getsReused++
+	}
 	cp.mu.Unlock()
+	return con, nil
+}
 
-	// Try to get an available container
+// waitForTenant queues the caller behind other waiters of the same tenant until a
+// container is handed over, ctx is done or the pool shuts down
+func (cp *ContainerPool) waitForTenant(ctx context.Context, tenant string) (*DockerContainer, error) {
+	cp.mu.Lock()
 	select {
 	case con := <-cp.availableContainers:
-		if cp.CheckContainerAlive(con) == nil {
-			return cp.GetContainer()
+		con.State = Busy
+		cp.mu.Unlock()
+		return con, nil
+	default:
+	}
+
+	waiter := make(chan *DockerContainer, 1)
+	if len(cp.tenantWaiters[tenant]) == 0 {
+		cp.waitingTenants = append(cp.waitingTenants, tenant)
+	}
+	cp.tenantWaiters[tenant] = append(cp.tenantWaiters[tenant], waiter)
+	cp.mu.Unlock()
+
+	var err error
+	select {
+	case con := <-waiter:
+		return con, nil
+	case <-cp.done:
+		err = ErrPoolClosed
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out waiting for an available container: %v", ctx.Err())
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.removeWaiter(tenant, waiter)
+
+	// A container may have been handed over before the waiter was removed
+	select {
+	case con := <-waiter:
+		if cp.closed {
+			con.State = Free
+		} else {
+			cp.makeAvailable(con)
+		}
+	default:
+	}
+	return nil, err
+}
+
+// makeAvailable hands a free container to the next waiting tenant, marking it Busy, or
+// returns it to availableContainers as Free if nobody is waiting. It never blocks: if
+// availableContainers is full the pool's bookkeeping is off, and the container is removed
+// instead. The caller must hold cp.mu.
+func (cp *ContainerPool) makeAvailable(con *DockerContainer) {
+	if len(cp.waitingTenants) == 0 {
+		con.State = Free
+		select {
+		case cp.availableContainers <- con:
+		default:
+			logz.Error(fmt.Sprintf("available containers channel is full, removing container %s", con.ID))
+			cp.removeContainer(con.ID)
+		}
+		return
+	}
+
+	tenant := cp.waitingTenants[0]
+	cp.waitingTenants = cp.waitingTenants[1:]
+	queue := cp.tenantWaiters[tenant]
+	if len(queue) > 1 {
+		cp.tenantWaiters[tenant] = queue[1:]
+		cp.waitingTenants = append(cp.waitingTenants, tenant)
+	} else {
+		delete(cp.tenantWaiters, tenant)
+	}
+	con.State = Busy
+	queue[0] <- con
+}
+
+// removeWaiter drops a waiter that gave up. The caller must hold cp.mu.
+func (cp *ContainerPool) removeWaiter(tenant string, waiter chan *DockerContainer) {
+	queue := cp.tenantWaiters[tenant]
+	for i, w := range queue {
+		if w == waiter {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		cp.tenantWaiters[tenant] = queue
+		return
+	}
+
+	delete(cp.tenantWaiters, tenant)
+	for i, t := range cp.waitingTenants {
+		if t == tenant {
+			cp.waitingTenants = append(cp.waitingTenants[:i], cp.waitingTenants[i+1:]...)
+			break
 		}
-		cp.lastUsedTime[con.ID] = time.Now()
+	}
+}
+
+// Stats returns the current container counts along with lifetime counters
+func (cp *ContainerPool) Stats() PoolStats {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	stats := PoolStats{
+		Total:       len(cp.containersList),
+		Created:     cp.createdCount,
+		Removed:     cp.removedCount,
+		GetsCreated: cp.getsCreated,
+		GetsReused:  cp.getsReused,
+	}
+	for _, con := range cp.containersList {
+		if con.State == Busy {
+			stats.Busy++
+		} else {
+			stats.Free++
+		}
+	}
+	return stats
+}
+
+// acquireContainer takes an available container, creates one if the pool is below
+// maxContainers, or waits for a release if wait is set. The bool reports a newly created container.
+func (cp *ContainerPool) acquireContainer(ctx context.Context, wait bool) (*DockerContainer, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, fmt.Errorf("get container canceled: %v", err)
+	}
+
+	// Check closed and mark the container Busy in the same critical section that takes it,
+	// so Shutdown's waitForRelease never misses a container that has left the channel
+	cp.mu.Lock()
+	if cp.closed {
+		cp.mu.Unlock()
+		return nil, false, ErrPoolClosed
+	}
+
+	// Try to get an available container
+	select {
+	case con := <-cp.availableContainers:
 		con.State = Busy
-		return con
+		cp.mu.Unlock()
+		return con, false, nil
 	default:
-		// No available containers, create new one if possible
-		if currentSize < cp.maxContainers {
-			cp.mu.Lock()
-			newContainer, err := cp.createContainer()
-			if err != nil {
-				cp.mu.Unlock()
-				logz.Error("Failed to create new container")
-				return nil
-			}
-			cp.containersList = append(cp.containersList, newContainer)
-			cp.lastUsedTime[newContainer.ID] = time.Now()
+	}
+
+	// No available containers, create new one if possible
+	if len(cp.containersList) < cp.maxContainers {
+		newContainer, err := cp.createContainer()
+		if err != nil {
 			cp.mu.Unlock()
-			
-			newContainer.State = Busy
-			return newContainer
+			return nil, false, fmt.Errorf("failed to create new container: %v", err)
 		}
+		newContainer.State = Busy
+		cp.addContainer(newContainer)
+		cp.mu.Unlock()
+		return newContainer, true, nil
+	}
+	cp.mu.Unlock()
 
-		// Wait for an available container if at max capacity
-		con := <-cp.availableContainers
-		if cp.CheckContainerAlive(con) == nil {
-			return cp.GetContainer()
+	if !wait {
+		return nil, false, ErrPoolExhausted
+	}
+
+	// Wait for an available container if at max capacity
+	select {
+	case con := <-cp.availableContainers:
+		cp.mu.Lock()
+		defer cp.mu.Unlock()
+		if cp.closed {
+			// Shutdown may already have stopped waiting, it removes this container with the rest
+			return nil, false, ErrPoolClosed
 		}
-		cp.lastUsedTime[con.ID] = time.Now()
 		con.State = Busy
-		return con
+		return con, false, nil
+	case <-cp.done:
+		return nil, false, ErrPoolClosed
+	case <-ctx.Done():
+		return nil, false, fmt.Errorf("timed out waiting for an available container: %v", ctx.Err())
 	}
 }
 
 func (cp *ContainerPool) ReleaseContainer(con *DockerContainer) {
-	if con != nil && con.State == Busy {
-		con.State = Free
-		cp.lastUsedTime[con.ID] = time.Now()
-		cp.availableContainers <- con
+	if con == nil {
+		return
 	}
+
+	// State is read by Stats and the background loops under cp.mu, so only change it there
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if con.State != Busy {
+		return
+	}
+	con.State = Free
+
+	if cp.closed {
+		return
+	}
+	if cp.recycleOnRelease[con.ID] && cp.recycleContainer(con.ID) == nil {
+		return
+	}
+	cp.lastUsedTime[con.ID] = time.Now()
+	cp.makeAvailable(con)
 }
 
 func (cp *ContainerPool) cleanupIdleContainers() {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-cp.done:
+			return
+		}
+
+		cp.recycleExpiredContainers()
+
 		cp.mu.Lock()
 		if len(cp.containersList) <= cp.minContainers {
 			cp.mu.Unlock()
@@ -158,12 +509,473 @@ func (cp *ContainerPool) cleanupIdleContainers() {
 	}
 }
 
-func (cp *ContainerPool) removeContainer(id string) {
+// Shutdown stops handing out containers, waits until busy containers are released or ctx
+// is done, then removes every container and closes the Docker client. Containers still
+// busy when ctx is done are removed as well and ctx's error is returned.
+func (cp *ContainerPool) Shutdown(ctx context.Context) error {
+	cp.mu.Lock()
+	if cp.closed {
+		cp.mu.Unlock()
+		return ErrPoolClosed
+	}
+	cp.closed = true
+	close(cp.done)
+	cp.mu.Unlock()
+
+	waitErr := cp.waitForRelease(ctx)
+
+	cp.mu.Lock()
+	for len(cp.availableContainers) > 0 {
+		<-cp.availableContainers
+	}
+	var removeErr error
+	for _, con := range cp.containersList {
+		if err := cp.removeContainer(con.ID); err != nil && removeErr == nil {
+			removeErr = fmt.Errorf("failed to remove container %s: %v", con.ID, err)
+		}
+	}
+	cp.mu.Unlock()
+
+	// persistLoop has stopped, so record what is left directly
+	cp.writeState()
+
+	if err := cp.client.Close(); err != nil && removeErr == nil {
+		removeErr = fmt.Errorf("failed to close Docker client: %v", err)
+	}
+
+	if waitErr != nil {
+		return waitErr
+	}
+	return removeErr
+}
+
+// waitForRelease polls until no container is busy or ctx is done
+func (cp *ContainerPool) waitForRelease(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if cp.Stats().Busy == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("shutdown with busy containers: %v", ctx.Err())
+		}
+	}
+}
+
+// EvictLRU removes the least recently used free container regardless of the idle timeout.
+// If the eviction takes the pool below minContainers, a replacement is created.
+func (cp *ContainerPool) EvictLRU() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	// A Free container missing from the channel is being health probed, so fall back to
+	// the next oldest
+	skipped := make(map[string]bool)
+	var oldest *DockerContainer
+	for {
+		oldest = nil
+		for _, con := range cp.containersList {
+			if con.State != Free || skipped[con.ID] {
+				continue
+			}
+			if oldest == nil || cp.lastUsedTime[con.ID].Before(cp.lastUsedTime[oldest.ID]) {
+				oldest = con
+			}
+		}
+		if oldest == nil {
+			return fmt.Errorf("no free container to evict")
+		}
+		if cp.takeAvailableContainer(oldest.ID) {
+			break
+		}
+		skipped[oldest.ID] = true
+	}
+
+	if err := cp.removeContainer(oldest.ID); err != nil {
+		cp.makeAvailable(oldest)
+		return fmt.Errorf("failed to evict container %s: %v", oldest.ID, err)
+	}
+
+	if len(cp.containersList) < cp.minContainers {
+		con, err := cp.createContainer()
+		if err != nil {
+			return fmt.Errorf("failed to recreate container after eviction: %v", err)
+		}
+		cp.addContainer(con)
+		cp.makeAvailable(con)
+	}
+
+	return nil
+}
+
+// recycleExpiredContainers replaces containers that have outlived maxLifetime. Free ones
+// are recycled immediately, busy ones are flagged and recycled when released.
+func (cp *ContainerPool) recycleExpiredContainers() {
+	if cp.maxLifetime <= 0 {
+		return
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	now := time.Now()
+	var expired []*DockerContainer
+	for _, con := range cp.containersList {
+		if created, exists := cp.createdTime[con.ID]; exists && now.Sub(created) > cp.maxLifetime {
+			expired = append(expired, con)
+		}
+	}
+
+	for _, con := range expired {
+		if con.State == Busy {
+			cp.recycleOnRelease[con.ID] = true
+			continue
+		}
+		if cp.takeAvailableContainer(con.ID) && cp.recycleContainer(con.ID) != nil {
+			cp.makeAvailable(con)
+		}
+	}
+}
+
+// recycleContainer removes a container that is not in availableContainers and creates a
+// replacement if the pool would otherwise drop below minContainers. On error the container
+// is left in the pool. The caller must hold cp.mu.
+func (cp *ContainerPool) recycleContainer(id string) error {
+	var replacement *DockerContainer
+	if len(cp.containersList)-1 < cp.minContainers {
+		con, err := cp.createContainer()
+		if err != nil {
+			logz.Error(fmt.Sprintf("failed to create replacement for container %s: %v", id, err))
+			return err
+		}
+		replacement = con
+	}
+
+	if err := cp.removeContainer(id); err != nil {
+		return err
+	}
+	delete(cp.recycleOnRelease, id)
+
+	if replacement != nil {
+		cp.addContainer(replacement)
+		cp.makeAvailable(replacement)
+	}
+	return nil
+}
+
+func (cp *ContainerPool) healthProbeLoop() {
+	ticker := time.NewTicker(cp.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cp.probeFreeContainers()
+		case <-cp.done:
+			return
+		}
+	}
+}
+
+// probeFreeContainers runs CheckAlive on the free containers one at a time and removes
+// the ones that fail. Only the container being probed is out of the pool, it is put back
+// or removed before the next one is taken. Busy containers are skipped. Removal below
+// minContainers triggers the background refill.
+func (cp *ContainerPool) probeFreeContainers() {
+	probed := make(map[string]bool)
+	for {
+		cp.mu.Lock()
+		if cp.closed {
+			cp.mu.Unlock()
+			return
+		}
+		var con *DockerContainer
+		select {
+		case con = <-cp.availableContainers:
+		default:
+		}
+		if con == nil || probed[con.ID] {
+			// Every free container has been probed once
+			if con != nil {
+				cp.makeAvailable(con)
+			}
+			cp.mu.Unlock()
+			return
+		}
+		probed[con.ID] = true
+		cp.mu.Unlock()
+
+		healthy := cp.probeContainer(con)
+
+		cp.mu.Lock()
+		if cp.closed {
+			// Shutdown removes the container with the rest
+			cp.mu.Unlock()
+			return
+		}
+		if healthy {
+			cp.makeAvailable(con)
+		} else {
+			logz.Error(fmt.Sprintf("container %s failed health probe, removing it", con.ID))
+			if err := cp.removeContainer(con.ID); err != nil {
+				cp.makeAvailable(con)
+			}
+		}
+		cp.mu.Unlock()
+	}
+}
+
+// probeContainer runs CheckAlive, treating a container that does not answer within
+// probeTimeout as unhealthy
+func (cp *ContainerPool) probeContainer(con *DockerContainer) bool {
+	result := make(chan bool, 1)
+	go func() {
+		result <- con.CheckAlive()
+	}()
+
+	timer := time.NewTimer(cp.probeTimeout)
+	defer timer.Stop()
+	select {
+	case healthy := <-result:
+		return healthy
+	case <-timer.C:
+		logz.Error(fmt.Sprintf("container %s did not answer the health probe within %s", con.ID, cp.probeTimeout))
+		return false
+	}
+}
+
+// reconcileLoop refills the pool to minContainers whenever a removal is signalled
+func (cp *ContainerPool) reconcileLoop() {
+	for {
+		select {
+		case <-cp.reconcile:
+			cp.refillToMin()
+		case <-cp.done:
+			return
+		}
+	}
+}
+
+// requestReconcile schedules a refill without blocking, repeated requests are coalesced
+func (cp *ContainerPool) requestReconcile() {
+	select {
+	case cp.reconcile <- struct{}{}:
+	default:
+	}
+}
+
+// refillToMin creates containers until the pool is back at minContainers, never going
+// past maxContainers
+func (cp *ContainerPool) refillToMin() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.closed {
+		return
+	}
+	for len(cp.containersList) < cp.minContainers && len(cp.containersList) < cp.maxContainers {
+		con, err := cp.createContainer()
+		if err != nil {
+			logz.Error(fmt.Sprintf("failed to refill container pool: %v", err))
+			return
+		}
+		cp.addContainer(con)
+		cp.makeAvailable(con)
+	}
+}
+
+// addContainer records a newly created container. The caller must hold cp.mu.
+func (cp *ContainerPool) addContainer(con *DockerContainer) {
+	now := time.Now()
+	cp.containersList = append(cp.containersList, con)
+	cp.lastUsedTime[con.ID] = now
+	cp.createdTime[con.ID] = now
+	cp.createdCount++
+	cp.saveState()
+}
+
+// restoreContainers handles containers recorded in stateFile by a previous run. With
+// OrphanPolicyReattach they are attached and added to the pool up to maxContainers,
+// otherwise, and for any beyond maxContainers, they are removed. IDs that fail to be
+// removed are kept in stateFile for the next start.
+func (cp *ContainerPool) restoreContainers() error {
+	if cp.stateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(cp.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read container state: %v", err)
+	}
+
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		// A corrupt file must not stop the pool from starting; the next save replaces it
+		logz.Error(fmt.Sprintf("failed to parse container state, starting with an empty pool: %v", err))
+		ids = nil
+	}
+
+	cp.mu.Lock()
+	for _, id := range ids {
+		if cp.orphanPolicy == OrphanPolicyReattach && len(cp.containersList) < cp.maxContainers {
+			con, err := cp.reattachContainer(id)
+			if err == nil {
+				cp.addContainer(con)
+				cp.makeAvailable(con)
+				continue
+			}
+			logz.Error(fmt.Sprintf("failed to reattach container %s, removing it: %v", id, err))
+		}
+
+		err := cp.client.ContainerRemove(context.Background(), id, container.RemoveOptions{Force: true})
+		if err != nil {
+			logz.Error(fmt.Sprintf("failed to remove orphaned container %s, keeping it in the state file: %v", id, err))
+			cp.orphans = append(cp.orphans, id)
+		}
+	}
+	cp.mu.Unlock()
+
+	cp.writeState()
+	return nil
+}
+
+func (cp *ContainerPool) reattachContainer(id string) (*DockerContainer, error) {
+	resp, err := cp.client.ContainerAttach(context.Background(), id, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DockerContainer{
+		ID:     id,
+		Stdin:  bufio.NewWriter(resp.Conn),
+		Stdout: bufio.NewScanner(resp.Reader),
+		State:  Free,
+	}, nil
+}
+
+// saveState schedules a write of the container IDs to stateFile without blocking,
+// repeated requests are coalesced. The caller must hold cp.mu.
+func (cp *ContainerPool) saveState() {
+	if cp.stateFile == "" {
+		return
+	}
+	select {
+	case cp.persist <- struct{}{}:
+	default:
+	}
+}
+
+// persistLoop writes the state file whenever saveState is called
+func (cp *ContainerPool) persistLoop() {
+	for {
+		select {
+		case <-cp.persist:
+			cp.writeState()
+		case <-cp.done:
+			return
+		}
+	}
+}
+
+// writeState snapshots the container and orphan IDs under cp.mu and writes them to
+// stateFile outside it. stateMu keeps writers in order so an older snapshot never
+// overwrites a newer one.
+func (cp *ContainerPool) writeState() {
+	cp.stateMu.Lock()
+	defer cp.stateMu.Unlock()
+
+	// This snapshot covers any write still pending
+	select {
+	case <-cp.persist:
+	default:
+	}
+
+	cp.mu.Lock()
+	path := cp.stateFile
+	ids := make([]string, 0, len(cp.containersList)+len(cp.orphans))
+	for _, con := range cp.containersList {
+		ids = append(ids, con.ID)
+	}
+	ids = append(ids, cp.orphans...)
+	cp.mu.Unlock()
+
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(ids)
+	if err != nil {
+		logz.Error(fmt.Sprintf("failed to encode container state: %v", err))
+		return
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		logz.Error(fmt.Sprintf("failed to write container state: %v", err))
+	}
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it over path, so a
+// crash mid-write never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+// takeAvailableContainer pulls the container with the given ID out of availableContainers
+// and puts every other container back. The caller must hold cp.mu.
+func (cp *ContainerPool) takeAvailableContainer(id string) bool {
+	found := false
+	for i := len(cp.availableContainers); i > 0; i-- {
+		select {
+		case con := <-cp.availableContainers:
+			if con.ID == id {
+				found = true
+				continue
+			}
+			cp.availableContainers <- con
+		default:
+			return found
+		}
+	}
+	return found
+}
+
+func (cp *ContainerPool) removeContainer(id string) error {
 	ctx := context.Background()
 	err := cp.client.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
 	if err != nil {
 		logz.Error(fmt.Sprintf("failed to remove container %s: %v", id, err))
-		return
+		return err
 	}
 
 	// Update containersList
@@ -175,6 +987,14 @@ func (cp *ContainerPool) removeContainer(id string) {
 	}
 	cp.containersList = newList
 	delete(cp.lastUsedTime, id)
+	delete(cp.createdTime, id)
+	cp.removedCount++
+	cp.saveState()
+
+	if !cp.closed && len(cp.containersList) < cp.minContainers {
+		cp.requestReconcile()
+	}
+	return nil
 }
 
 // Rest of the methods remain the same...
\ No newline at end of file
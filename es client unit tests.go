@@ -0,0 +1,421 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"orenctl/internal/app/helper"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAliasResponse = `{"events-000001":{"aliases":{"events":{"is_write_index":true}}}}`
+
+// mockTransport routes every Elasticsearch request to handler
+type mockTransport struct {
+	handler func(req *http.Request) (*http.Response, error)
+}
+
+func (m *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return m.handler(req)
+}
+
+func newMockResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Header: http.Header{
+			"Content-Type":      []string{"application/json"},
+			"X-Elastic-Product": []string{"Elasticsearch"},
+		},
+	}
+}
+
+func newMockESClient(t *testing.T, maxConcurrentBulk int, handler func(req *http.Request) (*http.Response, error)) *ESClient {
+	es, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{"http://localhost:9200"},
+		Transport: &mockTransport{handler: handler},
+	})
+	if err != nil {
+		t.Fatalf("failed to create elasticsearch client: %v", err)
+	}
+	return newESClient(es, maxConcurrentBulk)
+}
+
+func TestESClient_BulkIndexDocuments_ConcurrencyLimit(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	client := newMockESClient(t, 2, func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "_alias") {
+			return newMockResponse(http.StatusOK, testAliasResponse), nil
+		}
+
+		current := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+
+		return newMockResponse(http.StatusOK, `{"errors":false,"items":[]}`), nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := client.BulkIndexDocuments("events", []interface{}{map[string]interface{}{"id": 1}})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(2))
+	assert.Greater(t, atomic.LoadInt32(&maxInFlight), int32(0))
+}
+
+func TestESClient_SearchContext_Canceled(t *testing.T) {
+	client := newMockESClient(t, 0, func(req *http.Request) (*http.Response, error) {
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(5 * time.Second):
+			return newMockResponse(http.StatusOK, `{"hits":{"hits":[]}}`), nil
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.SearchContext(ctx, "events", helper.Map{"query": helper.Map{"match_all": helper.Map{}}}, 10)
+
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestESClient_SearchAll(t *testing.T) {
+	var mu sync.Mutex
+	var searchBodies []map[string]interface{}
+	closed := false
+
+	client := newMockESClient(t, 0, func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/_pit"):
+			return newMockResponse(http.StatusOK, `{"id":"pit-1"}`), nil
+		case req.Method == http.MethodDelete && req.URL.Path == "/_pit":
+			closed = true
+			return newMockResponse(http.StatusOK, `{"succeeded":true}`), nil
+		case req.URL.Path == "/_search":
+			var body map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Errorf("failed to decode search body: %v", err)
+			}
+			searchBodies = append(searchBodies, body)
+
+			// Two full pages of 2 hits followed by a final page of 1
+			page := len(searchBodies)
+			count := 2
+			if page == 3 {
+				count = 1
+			}
+			var hits []string
+			for i := 0; i < count; i++ {
+				n := (page-1)*2 + i
+				hits = append(hits, fmt.Sprintf(`{"_id":"%d","_source":{"n":%d},"sort":[%d]}`, n, n, n))
+			}
+			return newMockResponse(http.StatusOK, fmt.Sprintf(`{"pit_id":"pit-1","hits":{"hits":[%s]}}`, strings.Join(hits, ","))), nil
+		}
+		return newMockResponse(http.StatusNotFound, `{}`), nil
+	})
+
+	docs, err := client.SearchAll(context.Background(), "events", helper.Map{"query": helper.Map{"match_all": helper.Map{}}}, 2)
+
+	assert.NoError(t, err)
+	assert.Len(t, docs, 5)
+	for i, doc := range docs {
+		assert.Equal(t, fmt.Sprint(i), doc["_id"])
+	}
+
+	assert.Len(t, searchBodies, 3)
+	assert.Equal(t, []interface{}{map[string]interface{}{"_shard_doc": "asc"}}, searchBodies[0]["sort"])
+	assert.NotContains(t, searchBodies[0], "search_after")
+	assert.Equal(t, []interface{}{float64(1)}, searchBodies[1]["search_after"])
+	assert.Equal(t, []interface{}{float64(3)}, searchBodies[2]["search_after"])
+	assert.True(t, closed)
+}
+
+func TestBackoffDelay(t *testing.T) {
+	opts := BackoffOptions{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     time.Second,
+		Multiplier:      2,
+	}
+
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for attempt, expected := range want {
+		assert.Equal(t, expected, backoffDelay(opts, attempt, 0), "attempt %d", attempt)
+	}
+
+	// Jitter only ever shortens the delay, by at most the configured fraction
+	opts.Jitter = 0.5
+	assert.Equal(t, 400*time.Millisecond, backoffDelay(opts, 2, 0))
+	assert.Equal(t, 200*time.Millisecond, backoffDelay(opts, 2, 1))
+	assert.Equal(t, 500*time.Millisecond, backoffDelay(opts, 10, 1))
+}
+
+func TestESClient_BulkIndexDocumentsWithRetryResult_RetriesFailedItems(t *testing.T) {
+	var bulkBodies []string
+
+	client := newMockESClient(t, 0, func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "_alias") {
+			return newMockResponse(http.StatusOK, testAliasResponse), nil
+		}
+
+		body, _ := io.ReadAll(req.Body)
+		bulkBodies = append(bulkBodies, string(body))
+
+		if len(bulkBodies) == 1 {
+			return newMockResponse(http.StatusOK, `{"errors":true,"items":[
+				{"index":{"status":201}},
+				{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},
+				{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}
+			]}`), nil
+		}
+		if strings.Contains(string(body), `"bad"`) {
+			return newMockResponse(http.StatusOK, `{"errors":true,"items":[{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`), nil
+		}
+		return newMockResponse(http.StatusOK, `{"errors":false,"items":[{"index":{"status":201}}]}`), nil
+	})
+
+	docs := []interface{}{
+		map[string]interface{}{"id": "ok"},
+		map[string]interface{}{"id": "rejected"},
+		map[string]interface{}{"id": "bad"},
+	}
+	result, err := client.BulkIndexDocumentsWithRetryResult("events", docs, 3, time.Millisecond)
+
+	assert.NoError(t, err)
+	assert.Len(t, bulkBodies, 2)
+	assert.Contains(t, bulkBodies[1], `"rejected"`)
+	assert.NotContains(t, bulkBodies[1], `"ok"`)
+	assert.NotContains(t, bulkBodies[1], `"bad"`)
+
+	assert.Equal(t, 2, result.Indexed)
+	assert.Len(t, result.Failed, 1)
+	assert.Equal(t, docs[2], result.Failed[0].Document)
+	assert.Equal(t, http.StatusBadRequest, result.Failed[0].Status)
+	assert.Contains(t, result.Failed[0].Error, "mapper_parsing_exception")
+
+	// A permanently failed document surfaces as an error from the plain retry variant
+	err = client.BulkIndexDocumentsWithRetry("events", docs[2:], 3, time.Millisecond)
+	assert.Error(t, err)
+	assert.Len(t, bulkBodies, 3)
+}
+
+func TestESClient_BulkIndexDocumentsWithRetryResult_MissingErrorsFlag(t *testing.T) {
+	client := newMockESClient(t, 0, func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "_alias") {
+			return newMockResponse(http.StatusOK, testAliasResponse), nil
+		}
+		return newMockResponse(http.StatusOK, `{"items":[{"index":{"status":201}}]}`), nil
+	})
+
+	docs := []interface{}{map[string]interface{}{"id": 1}}
+	result, err := client.BulkIndexDocumentsWithRetryResult("events", docs, 1, time.Millisecond)
+
+	// Without the flag the response cannot count as success
+	assert.NoError(t, err)
+	assert.Zero(t, result.Indexed)
+	assert.Len(t, result.Failed, 1)
+	assert.Contains(t, result.Failed[0].Error, "no errors flag")
+	assert.Error(t, client.BulkIndexDocumentsWithRetry("events", docs, 1, time.Millisecond))
+}
+
+func TestESClient_getWriteIndexForAlias_Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"index is not an object", `{"events-000001":"oops"}`},
+		{"missing aliases", `{"events-000001":{}}`},
+		{"aliases is not an object", `{"events-000001":{"aliases":[]}}`},
+		{"is_write_index is not a bool", `{"events-000001":{"aliases":{"events":{"is_write_index":"true"}}}}`},
+		{"alias info is not an object", `{"events-000001":{"aliases":{"events":true}}}`},
+		{"invalid JSON", `{"events-000001":`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newMockESClient(t, 0, func(req *http.Request) (*http.Response, error) {
+				return newMockResponse(http.StatusOK, tt.body), nil
+			})
+
+			assert.NotPanics(t, func() {
+				_, err := client.getWriteIndexForAlias("events")
+				assert.Error(t, err)
+			})
+		})
+	}
+}
+
+func TestESClient_BulkIndexDocuments_MissingErrorsFlag(t *testing.T) {
+	client := newMockESClient(t, 0, func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "_alias") {
+			return newMockResponse(http.StatusOK, testAliasResponse), nil
+		}
+		return newMockResponse(http.StatusOK, `{"items":[]}`), nil
+	})
+
+	assert.NotPanics(t, func() {
+		err := client.BulkIndexDocuments("events", []interface{}{map[string]interface{}{"id": 1}})
+		assert.Error(t, err)
+	})
+}
+
+func TestESClient_RolloverAlias(t *testing.T) {
+	viper.Set("elastic.event.prefix", "tenant1-")
+	defer viper.Set("elastic.event.prefix", "")
+
+	var path string
+	var body map[string]interface{}
+	client := newMockESClient(t, 0, func(req *http.Request) (*http.Response, error) {
+		path = req.URL.Path
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode rollover body: %v", err)
+		}
+		return newMockResponse(http.StatusOK, `{"acknowledged":true,"old_index":"tenant1-events-000001","new_index":"tenant1-events-000002","rolled_over":true,"dry_run":false}`), nil
+	})
+
+	rolledOver, newIndex, err := client.RolloverAlias(context.Background(), "events", map[string]interface{}{
+		"max_age":  "7d",
+		"max_docs": 1000000,
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, rolledOver)
+	assert.Equal(t, "tenant1-events-000002", newIndex)
+	assert.Equal(t, "/tenant1-events/_rollover", path)
+	assert.Equal(t, map[string]interface{}{
+		"conditions": map[string]interface{}{
+			"max_age":  "7d",
+			"max_docs": float64(1000000),
+		},
+	}, body)
+}
+
+func TestQueryBuilder_Build(t *testing.T) {
+	query := NewQuery().
+		Must(
+			Term("tenant", "tenant1"),
+			Range("@timestamp").Gte("now-1d").Lt("now"),
+		).
+		Should(Term("severity", "high"), Term("severity", "critical")).
+		Size(50).
+		Sort("@timestamp", "desc").
+		Build()
+
+	got, err := json.Marshal(query)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"query": {
+			"bool": {
+				"must": [
+					{"term": {"tenant": "tenant1"}},
+					{"range": {"@timestamp": {"gte": "now-1d", "lt": "now"}}}
+				],
+				"should": [
+					{"term": {"severity": "high"}},
+					{"term": {"severity": "critical"}}
+				]
+			}
+		},
+		"size": 50,
+		"sort": [{"@timestamp": {"order": "desc"}}]
+	}`, string(got))
+}
+
+func TestQueryBuilder_Build_MatchAll(t *testing.T) {
+	got, err := json.Marshal(NewQuery().Build())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"query": {"match_all": {}}}`, string(got))
+}
+
+func TestESClient_Count(t *testing.T) {
+	viper.Set("elastic.event.prefix", "tenant1-")
+	defer viper.Set("elastic.event.prefix", "")
+
+	var path string
+	var body map[string]interface{}
+	client := newMockESClient(t, 0, func(req *http.Request) (*http.Response, error) {
+		path = req.URL.Path
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode count body: %v", err)
+		}
+		return newMockResponse(http.StatusOK, `{"count":42,"_shards":{"total":1,"successful":1,"skipped":0,"failed":0}}`), nil
+	})
+
+	count, err := client.Count(context.Background(), "events", NewQuery().Must(Term("tenant", "tenant1")).Size(10).Build())
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), count)
+	assert.Equal(t, "/tenant1-events/_count", path)
+	assert.NotContains(t, body, "size")
+	assert.Contains(t, body, "query")
+}
+
+func TestESClient_DeleteByQuery(t *testing.T) {
+	viper.Set("elastic.event.prefix", "tenant1-")
+	defer viper.Set("elastic.event.prefix", "")
+
+	var path, conflicts string
+	var body map[string]interface{}
+	client := newMockESClient(t, 0, func(req *http.Request) (*http.Response, error) {
+		path = req.URL.Path
+		conflicts = req.URL.Query().Get("conflicts")
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode delete by query body: %v", err)
+		}
+		return newMockResponse(http.StatusOK, `{"took":12,"deleted":7,"version_conflicts":1,"failures":[]}`), nil
+	})
+
+	query := NewQuery().Must(Term("tenant", "tenant1")).Build()
+	deleted, err := client.DeleteByQuery(context.Background(), "events", query, WithConflictsProceed())
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), deleted)
+	assert.Equal(t, "/tenant1-events/_delete_by_query", path)
+	assert.Equal(t, "proceed", conflicts)
+	assert.Equal(t, map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{"tenant": "tenant1"}},
+				},
+			},
+		},
+	}, body)
+}
@@ -0,0 +1,123 @@
+package queue
+
+import "orenctl/internal/app/helper"
+
+// Clause is a single query clause that can be added to a QueryBuilder
+type Clause interface {
+	Source() helper.Map
+}
+
+type termClause struct {
+	field string
+	value interface{}
+}
+
+// Term matches documents whose field holds exactly value
+func Term(field string, value interface{}) Clause {
+	return termClause{field: field, value: value}
+}
+
+func (t termClause) Source() helper.Map {
+	return helper.Map{"term": helper.Map{t.field: t.value}}
+}
+
+// RangeClause matches documents whose field falls within the configured bounds
+type RangeClause struct {
+	field  string
+	bounds helper.Map
+}
+
+func Range(field string) *RangeClause {
+	return &RangeClause{field: field, bounds: helper.Map{}}
+}
+
+func (r *RangeClause) Gt(value interface{}) *RangeClause {
+	r.bounds["gt"] = value
+	return r
+}
+
+func (r *RangeClause) Gte(value interface{}) *RangeClause {
+	r.bounds["gte"] = value
+	return r
+}
+
+func (r *RangeClause) Lt(value interface{}) *RangeClause {
+	r.bounds["lt"] = value
+	return r
+}
+
+func (r *RangeClause) Lte(value interface{}) *RangeClause {
+	r.bounds["lte"] = value
+	return r
+}
+
+func (r *RangeClause) Source() helper.Map {
+	return helper.Map{"range": helper.Map{r.field: r.bounds}}
+}
+
+// QueryBuilder builds the helper.Map query body passed to ESClient.Search
+type QueryBuilder struct {
+	must   []Clause
+	should []Clause
+	sort   []interface{}
+	size   *int
+}
+
+func NewQuery() *QueryBuilder {
+	return &QueryBuilder{}
+}
+
+// Must adds clauses that every matching document has to satisfy
+func (q *QueryBuilder) Must(clauses ...Clause) *QueryBuilder {
+	q.must = append(q.must, clauses...)
+	return q
+}
+
+// Should adds clauses of which at least one has to match when there are no Must clauses
+func (q *QueryBuilder) Should(clauses ...Clause) *QueryBuilder {
+	q.should = append(q.should, clauses...)
+	return q
+}
+
+func (q *QueryBuilder) Size(size int) *QueryBuilder {
+	q.size = &size
+	return q
+}
+
+// Sort orders hits by field, order is "asc" or "desc". Repeated calls add tiebreakers.
+func (q *QueryBuilder) Sort(field, order string) *QueryBuilder {
+	q.sort = append(q.sort, helper.Map{field: helper.Map{"order": order}})
+	return q
+}
+
+// Build returns the query body. Without any clauses it matches all documents.
+func (q *QueryBuilder) Build() helper.Map {
+	query := helper.Map{"match_all": helper.Map{}}
+	if len(q.must) > 0 || len(q.should) > 0 {
+		boolQuery := helper.Map{}
+		if len(q.must) > 0 {
+			boolQuery["must"] = clauseSources(q.must)
+		}
+		if len(q.should) > 0 {
+			boolQuery["should"] = clauseSources(q.should)
+		}
+		query = helper.Map{"bool": boolQuery}
+	}
+
+	body := helper.Map{"query": query}
+	if q.size != nil {
+		body["size"] = *q.size
+	}
+	if len(q.sort) > 0 {
+		body["sort"] = q.sort
+	}
+	return body
+}
+
+func clauseSources(clauses []Clause) []interface{} {
+	sources := make([]interface{}, len(clauses))
+	for i, clause := range clauses {
+		sources[i] = clause.Source()
+	}
+	return sources
+}
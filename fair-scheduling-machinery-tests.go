@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestFairScheduler returns a scheduler backed by an in-memory Redis that records
+// dispatched task IDs instead of sending them to machinery
+func newTestFairScheduler(t *testing.T, tenants ...string) (*FairScheduler, *dispatchRecorder) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	recorder := &dispatchRecorder{}
+	fs := &FairScheduler{
+		tenantQueues: make(map[string]string),
+		weights:      make(map[string]int),
+		redisClient:  redis.NewClient(&redis.Options{Addr: mr.Addr()}),
+		dispatch:     recorder.dispatch,
+	}
+	for _, tenant := range tenants {
+		fs.AddTenant(tenant)
+	}
+	return fs, recorder
+}
+
+// dispatchRecorder records the task IDs a FairScheduler dispatches
+type dispatchRecorder struct {
+	mu      sync.Mutex
+	taskIDs []string
+}
+
+func (r *dispatchRecorder) dispatch(taskID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.taskIDs = append(r.taskIDs, taskID)
+	return nil
+}
+
+func (r *dispatchRecorder) dispatched() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.taskIDs...)
+}
+
+// Test that dispatch slots follow the configured tenant weights
+func TestWeightedCycleFollowsWeights(t *testing.T) {
+	viper.Set("scheduler.tenant_weights.gold", 5)
+	viper.Set("scheduler.tenant_weights.silver", 3)
+	defer viper.Reset()
+
+	tenants := []string{"gold", "silver", "bronze"}
+	weights := make(map[string]int)
+	for _, tenant := range tenants {
+		weights[tenant] = tenantWeight(tenant)
+	}
+
+	const cycles = 100
+	counts := make(map[string]int)
+	for i := 0; i < cycles; i++ {
+		for _, tenant := range weightedCycle(tenants, weights) {
+			counts[tenant]++
+		}
+	}
+
+	assert.Equal(t, 5*cycles, counts["gold"])
+	assert.Equal(t, 3*cycles, counts["silver"])
+	// Unconfigured tenants still get a slot every cycle
+	assert.Equal(t, cycles, counts["bronze"])
+	assert.InDelta(t, 5.0/3.0, float64(counts["gold"])/float64(counts["silver"]), 0.01)
+}
+
+// Test that a heavy tenant's slots are interleaved with the others
+func TestWeightedCycleInterleaves(t *testing.T) {
+	cycle := weightedCycle([]string{"a", "b"}, map[string]int{"a": 3, "b": 1})
+
+	assert.Equal(t, []string{"a", "a", "b", "a"}, cycle)
+}
+
+// Test that the fair loop, not EnqueueTask, decides each tenant's share of dispatches
+func TestFairSchedulerDistributeCycleFollowsWeights(t *testing.T) {
+	viper.Set("scheduler.tenant_weights.gold", 3)
+	defer viper.Reset()
+
+	fs, recorder := newTestFairScheduler(t, "gold", "bronze")
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, fs.EnqueueTask("gold", "email", i))
+		assert.NoError(t, fs.EnqueueTask("bronze", "email", i))
+	}
+	assert.Empty(t, recorder.dispatched())
+
+	const cycles = 5
+	for i := 0; i < cycles; i++ {
+		fs.distributeCycle()
+	}
+
+	counts := make(map[string]int)
+	for _, taskID := range recorder.dispatched() {
+		if strings.HasPrefix(taskID, "task:gold:") {
+			counts["gold"]++
+		} else {
+			counts["bronze"]++
+		}
+	}
+	assert.Equal(t, 3*cycles, counts["gold"])
+	assert.Equal(t, cycles, counts["bronze"])
+}
+
+// Test that a tenant added at runtime is served by the distribution loop
+func TestFairSchedulerAddTenant(t *testing.T) {
+	fs, recorder := newTestFairScheduler(t, "tenant1")
+
+	assert.Error(t, fs.EnqueueTask("tenant2", "email", nil))
+
+	fs.AddTenant("tenant2")
+	assert.NoError(t, fs.EnqueueTask("tenant2", "email", map[string]interface{}{"to": "user@example.com"}))
+	queued, err := fs.redisClient.LRange(context.Background(), tenantQueue("tenant2"), 0, -1).Result()
+	assert.NoError(t, err)
+	assert.Len(t, queued, 1)
+	assert.Empty(t, recorder.dispatched(), "EnqueueTask must leave dispatching to the fair loop")
+
+	fs.distributeCycle()
+
+	assert.Equal(t, queued, recorder.dispatched())
+	assert.Equal(t, []string{"tenant1", "tenant2"}, fs.tenants)
+}
+
+// Test that removing a tenant drains its queue
+func TestFairSchedulerRemoveTenant(t *testing.T) {
+	fs, recorder := newTestFairScheduler(t, "tenant1", "tenant2")
+	assert.NoError(t, fs.EnqueueTask("tenant2", "email", nil))
+	assert.NoError(t, fs.EnqueueTask("tenant2", "report", nil))
+	assert.Empty(t, recorder.dispatched())
+
+	assert.NoError(t, fs.RemoveTenant("tenant2"))
+
+	assert.Len(t, recorder.dispatched(), 2)
+	assert.Equal(t, []string{"tenant1"}, fs.tenants)
+	length, err := fs.redisClient.LLen(context.Background(), tenantQueue("tenant2")).Result()
+	assert.NoError(t, err)
+	assert.Zero(t, length)
+	assert.Error(t, fs.EnqueueTask("tenant2", "email", nil))
+}
+
+// Test that a task whose dispatch fails during the drain stays queued for a retry
+func TestFairSchedulerRemoveTenantDispatchFails(t *testing.T) {
+	fs, recorder := newTestFairScheduler(t, "tenant1")
+	assert.NoError(t, fs.EnqueueTask("tenant1", "email", nil))
+	assert.NoError(t, fs.EnqueueTask("tenant1", "report", nil))
+
+	fs.dispatch = func(taskID string) error {
+		return errors.New("broker unavailable")
+	}
+	assert.Error(t, fs.RemoveTenant("tenant1"))
+	length, err := fs.redisClient.LLen(context.Background(), tenantQueue("tenant1")).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), length)
+
+	fs.dispatch = recorder.dispatch
+	assert.NoError(t, fs.RemoveTenant("tenant1"))
+	assert.Len(t, recorder.dispatched(), 2)
+}
+
+// Test that no accepted task is stranded when a tenant is removed during enqueues
+func TestFairSchedulerRemoveTenantConcurrentEnqueue(t *testing.T) {
+	fs, recorder := newTestFairScheduler(t, "tenant1")
+
+	var accepted int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if fs.EnqueueTask("tenant1", "email", j) == nil {
+					atomic.AddInt64(&accepted, 1)
+				}
+			}
+		}()
+	}
+	assert.NoError(t, fs.RemoveTenant("tenant1"))
+	wg.Wait()
+
+	length, err := fs.redisClient.LLen(context.Background(), tenantQueue("tenant1")).Result()
+	assert.NoError(t, err)
+	assert.Zero(t, length)
+	assert.Len(t, recorder.dispatched(), int(atomic.LoadInt64(&accepted)))
+}
+
+// Test that AddTenant does not write into the slice passed to NewFairScheduler
+func TestFairSchedulerCopiesTenants(t *testing.T) {
+	tenants := make([]string, 1, 2)
+	tenants[0] = "tenant1"
+
+	fs, err := NewFairScheduler("redis://localhost:6379", tenants)
+	if err != nil {
+		t.Skipf("machinery server unavailable: %v", err)
+	}
+	fs.AddTenant("tenant2")
+
+	assert.Equal(t, []string{"tenant1"}, tenants)
+	assert.Equal(t, "", tenants[:2][1])
+}
+
+// Test that EnqueueTask rejects tasks once a tenant's queue is at its max depth
+func TestFairSchedulerEnqueueTaskQueueFull(t *testing.T) {
+	viper.Set("scheduler.max_queue_depth", 10)
+	viper.Set("scheduler.tenant_max_queue_depth.tenant2", 3)
+	defer viper.Reset()
+
+	fs, recorder := newTestFairScheduler(t, "tenant1", "tenant2")
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, fs.EnqueueTask("tenant2", "email", i))
+	}
+	for i := 0; i < 2; i++ {
+		err := fs.EnqueueTask("tenant2", "email", i)
+		assert.ErrorIs(t, err, ErrQueueFull)
+	}
+
+	length, err := fs.redisClient.LLen(context.Background(), tenantQueue("tenant2")).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), length)
+	// Rejected tasks leave no task data behind
+	keys, err := fs.redisClient.Keys(context.Background(), "task:tenant2:*").Result()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+
+	// Accepted tasks wait for the fair loop rather than being dispatched on enqueue
+	assert.Empty(t, recorder.dispatched())
+
+	// Other tenants use the global limit, and the cap frees up as tasks are dispatched
+	assert.NoError(t, fs.EnqueueTask("tenant1", "email", nil))
+	fs.distributeCycle()
+	assert.Len(t, recorder.dispatched(), 2)
+	assert.NoError(t, fs.EnqueueTask("tenant2", "email", nil))
+	assert.ErrorIs(t, fs.EnqueueTask("tenant2", "email", nil), ErrQueueFull)
+
+	// Every accepted task is dispatched exactly once
+	for i := 0; i < 3; i++ {
+		fs.distributeCycle()
+	}
+	seen := make(map[string]int)
+	for _, taskID := range recorder.dispatched() {
+		seen[taskID]++
+	}
+	assert.Len(t, seen, 5)
+	for taskID, count := range seen {
+		assert.Equal(t, 1, count, "task %s dispatched %d times", taskID, count)
+	}
+}
@@ -3,20 +3,40 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/RichardKnop/machinery/v2"
 	"github.com/RichardKnop/machinery/v2/config"
 	"github.com/RichardKnop/machinery/v2/tasks"
 	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
 )
 
+// ErrQueueFull is returned by EnqueueTask when a tenant already has its max depth of tasks
+// waiting for a fair slot
+var ErrQueueFull = errors.New("tenant queue is full")
+
+// pushIfBelowDepth pushes ARGV[1] onto KEYS[1] unless the list already holds ARGV[2] or
+// more items, returning -1 in that case. A depth of 0 means unlimited.
+var pushIfBelowDepth = redis.NewScript(`
+local depth = tonumber(ARGV[2])
+if depth > 0 and redis.call('LLEN', KEYS[1]) >= depth then
+	return -1
+end
+return redis.call('LPUSH', KEYS[1], ARGV[1])
+`)
+
 type FairScheduler struct {
 	server       *machinery.Server
+	mu           sync.RWMutex // guards tenantQueues, tenants and weights
 	tenantQueues map[string]string
 	tenants      []string
+	weights      map[string]int
 	redisClient  *redis.Client
+	dispatch     func(taskID string) error
 }
 
 type TaskData struct {
@@ -42,19 +62,137 @@ func NewFairScheduler(redisURL string, tenants []string) (*FairScheduler, error)
 	})
 
 	tenantQueues := make(map[string]string)
+	weights := make(map[string]int)
 	for _, tenant := range tenants {
-		tenantQueues[tenant] = fmt.Sprintf("tenant:%s:tasks", tenant)
+		tenantQueues[tenant] = tenantQueue(tenant)
+		weights[tenant] = tenantWeight(tenant)
 	}
 
-	return &FairScheduler{
+	// Copy tenants so AddTenant never appends into the caller's backing array
+	fs := &FairScheduler{
 		server:       server,
 		tenantQueues: tenantQueues,
-		tenants:      tenants,
+		tenants:      append([]string(nil), tenants...),
+		weights:      weights,
 		redisClient:  redisClient,
-	}, nil
+	}
+	fs.dispatch = fs.sendTask
+	return fs, nil
+}
+
+func tenantQueue(tenant string) string {
+	return fmt.Sprintf("tenant:%s:tasks", tenant)
+}
+
+// AddTenant registers a tenant so the distribution loop starts serving its queue. Adding
+// a registered tenant is a no-op.
+func (fs *FairScheduler) AddTenant(tenant string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, exists := fs.tenantQueues[tenant]; exists {
+		return
+	}
+	// The Redis list itself is created by the first LPush
+	fs.tenantQueues[tenant] = tenantQueue(tenant)
+	fs.weights[tenant] = tenantWeight(tenant)
+	fs.tenants = append(fs.tenants, tenant)
+}
+
+// RemoveTenant unregisters a tenant and dispatches the tasks still in its queue so they
+// are not lost. If a dispatch fails the task is pushed back and the error returned, calling
+// RemoveTenant again resumes the drain.
+func (fs *FairScheduler) RemoveTenant(tenant string) error {
+	// EnqueueTask holds the read lock until its push is done, so once the tenant is
+	// unregistered here no task can land in the queue after the drain below
+	fs.mu.Lock()
+	if _, exists := fs.tenantQueues[tenant]; exists {
+		delete(fs.tenantQueues, tenant)
+		delete(fs.weights, tenant)
+		tenants := make([]string, 0, len(fs.tenants)-1)
+		for _, t := range fs.tenants {
+			if t != tenant {
+				tenants = append(tenants, t)
+			}
+		}
+		fs.tenants = tenants
+	}
+	fs.mu.Unlock()
+
+	queue := tenantQueue(tenant)
+	for {
+		taskID, err := fs.redisClient.RPop(context.Background(), queue).Result()
+		if err == redis.Nil {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to drain queue for tenant %s: %v", tenant, err)
+		}
+
+		if err := fs.dispatch(taskID); err != nil {
+			// RPop took it from the tail, so RPush puts it back where it was
+			if pushErr := fs.redisClient.RPush(context.Background(), queue, taskID).Err(); pushErr != nil {
+				fmt.Printf("Error returning task %s to queue %s: %v\n", taskID, queue, pushErr)
+			}
+			return fmt.Errorf("failed to dispatch task %s for tenant %s: %v", taskID, tenant, err)
+		}
+	}
+}
+
+// tenantWeight returns the number of dispatch slots a tenant gets per cycle, configured
+// by scheduler.tenant_weights.<tenant>. It is at least 1 so every tenant is served each cycle.
+func tenantWeight(tenant string) int {
+	weight := viper.GetInt(fmt.Sprintf("scheduler.tenant_weights.%s", tenant))
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+// maxQueueDepth returns the most tasks a tenant may have waiting for a fair slot, configured
+// by scheduler.tenant_max_queue_depth.<tenant> or else scheduler.max_queue_depth. Tasks
+// stop counting once the distribution loop dispatches them. 0 means unlimited.
+func maxQueueDepth(tenant string) int {
+	key := fmt.Sprintf("scheduler.tenant_max_queue_depth.%s", tenant)
+	if viper.IsSet(key) {
+		return viper.GetInt(key)
+	}
+	return viper.GetInt("scheduler.max_queue_depth")
+}
+
+// weightedCycle returns the order in which tenants get dispatch slots for one cycle. Each
+// tenant appears as many times as its weight, and smooth weighted round-robin spreads a
+// heavy tenant's slots between the others instead of serving them back to back.
+func weightedCycle(tenants []string, weights map[string]int) []string {
+	total := 0
+	for _, tenant := range tenants {
+		total += weights[tenant]
+	}
+
+	current := make(map[string]int, len(tenants))
+	cycle := make([]string, 0, total)
+	for len(cycle) < total {
+		best := ""
+		for _, tenant := range tenants {
+			current[tenant] += weights[tenant]
+			if best == "" || current[tenant] > current[best] {
+				best = tenant
+			}
+		}
+		current[best] -= total
+		cycle = append(cycle, best)
+	}
+	return cycle
 }
 
 func (fs *FairScheduler) EnqueueTask(tenant string, taskType string, payload interface{}) error {
+	// Hold the read lock through the push so RemoveTenant cannot drain the queue in between
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	queue, exists := fs.tenantQueues[tenant]
+	if !exists {
+		return fmt.Errorf("unknown tenant %s", tenant)
+	}
+
 	taskData := TaskData{
 		TenantID: tenant,
 		TaskType: taskType,
@@ -73,6 +211,24 @@ func (fs *FairScheduler) EnqueueTask(tenant string, taskType string, payload int
 		return err
 	}
 
+	// Check the depth and push in one script so concurrent producers cannot overshoot the cap
+	pushed, err := pushIfBelowDepth.Run(context.Background(), fs.redisClient, []string{queue}, taskID, maxQueueDepth(tenant)).Int()
+	if err != nil {
+		return err
+	}
+	if pushed < 0 {
+		if err := fs.redisClient.Del(context.Background(), taskID).Err(); err != nil {
+			fmt.Printf("Error deleting rejected task %s: %v\n", taskID, err)
+		}
+		return fmt.Errorf("%w for tenant %s", ErrQueueFull, tenant)
+	}
+
+	// The fair distribution loop dispatches the task when the tenant's slot comes up
+	return nil
+}
+
+// sendTask sends a processTask for taskID to the machinery server
+func (fs *FairScheduler) sendTask(taskID string) error {
 	signature := &tasks.Signature{
 		Name: "processTask",
 		Args: []tasks.Arg{
@@ -83,12 +239,8 @@ func (fs *FairScheduler) EnqueueTask(tenant string, taskType string, payload int
 		},
 	}
 
-	_, err = fs.server.SendTask(signature)
-	if err != nil {
-		return err
-	}
-
-	return fs.redisClient.LPush(context.Background(), fs.tenantQueues[tenant], taskID).Err()
+	_, err := fs.server.SendTask(signature)
+	return err
 }
 
 func (fs *FairScheduler) processTask(taskID string) error {
@@ -132,32 +284,42 @@ func (fs *FairScheduler) StartWorker(concurrency int) error {
 
 func (fs *FairScheduler) fairDistributionLoop() {
 	for {
-		for _, tenant := range fs.tenants {
-			taskID, err := fs.redisClient.RPop(context.Background(), fs.tenantQueues[tenant]).Result()
-			if err == redis.Nil {
-				continue
-			} else if err != nil {
-				fmt.Printf("Error getting task for tenant %s: %v\n", tenant, err)
-				continue
-			}
+		fs.distributeCycle()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
 
-			signature := &tasks.Signature{
-				Name: "processTask",
-				Args: []tasks.Arg{
-					{
-						Type:  "string",
-						Value: taskID,
-					},
-				},
-			}
+// distributeCycle dispatches one weighted cycle of tasks from the tenant queues
+func (fs *FairScheduler) distributeCycle() {
+	// Work from a snapshot so tenants can be added or removed mid-cycle
+	fs.mu.RLock()
+	cycle := weightedCycle(fs.tenants, fs.weights)
+	queues := make(map[string]string, len(fs.tenantQueues))
+	for tenant, queue := range fs.tenantQueues {
+		queues[tenant] = queue
+	}
+	fs.mu.RUnlock()
 
-			_, err = fs.server.SendTask(signature)
-			if err != nil {
-				fmt.Printf("Error queueing task %s: %v\n", taskID, err)
-			}
+	// Tenants with an empty queue give up the rest of their slots for this cycle
+	empty := make(map[string]bool)
+	for _, tenant := range cycle {
+		if empty[tenant] {
+			continue
 		}
 
-		time.Sleep(100 * time.Millisecond)
+		taskID, err := fs.redisClient.RPop(context.Background(), queues[tenant]).Result()
+		if err == redis.Nil {
+			empty[tenant] = true
+			continue
+		} else if err != nil {
+			fmt.Printf("Error getting task for tenant %s: %v\n", tenant, err)
+			continue
+		}
+
+		err = fs.dispatch(taskID)
+		if err != nil {
+			fmt.Printf("Error queueing task %s: %v\n", taskID, err)
+		}
 	}
 }
 
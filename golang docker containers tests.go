@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// dockerFrame wraps payload in a Docker multiplexed stream header for stdout
+func dockerFrame(payload []byte) []byte {
+	header := make([]byte, 8)
+	header[0] = 1
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestOutputScanner_LargeResult(t *testing.T) {
+	viper.Reset()
+
+	// A single JSON result line larger than bufio's 64KB default, split across frames
+	line := `{"type":"result","results":{"data":"` + strings.Repeat("x", 200*1024) + `"}}`
+	var stream bytes.Buffer
+	for i := 0; i < len(line); i += 32 * 1024 {
+		end := i + 32*1024
+		if end > len(line) {
+			end = len(line)
+		}
+		stream.Write(dockerFrame([]byte(line[i:end])))
+	}
+	stream.Write(dockerFrame([]byte("\n")))
+
+	scanner := newOutputScanner(&adaptiveReader{reader: &stream})
+	if !scanner.Scan() {
+		t.Fatalf("Scan() failed on a large result: %v", scanner.Err())
+	}
+	if got := scanner.Text(); got != line {
+		t.Errorf("Scan() returned %d bytes, want %d", len(got), len(line))
+	}
+}
+
+func TestOutputScanner_LineTooLong(t *testing.T) {
+	viper.Reset()
+	viper.Set("worker.max_output_bytes", 64*1024)
+
+	line := strings.Repeat("x", 100*1024) + "\n"
+	scanner := newOutputScanner(&adaptiveReader{reader: bytes.NewReader(dockerFrame([]byte(line)))})
+
+	if scanner.Scan() {
+		t.Fatalf("Scan() succeeded on a line larger than worker.max_output_bytes")
+	}
+	if scanner.Err() == nil {
+		t.Errorf("Scan() expected an error for a line larger than worker.max_output_bytes")
+	}
+}
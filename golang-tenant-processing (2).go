@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -120,6 +122,37 @@ func (cp *ContainerPool) ReleaseContainer(container *DockerContainer) {
 	cp.containers <- container
 }
 
+// Close stops and removes every container in the pool and closes the Docker client.
+// Containers must have been released first.
+func (cp *ContainerPool) Close() error {
+	ctx := context.Background()
+	var firstErr error
+
+	for len(cp.containers) > 0 {
+		con := <-cp.containers
+		if err := cp.client.ContainerStop(ctx, con.ID, container.StopOptions{}); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to stop container %s: %v", con.ID, err)
+		}
+		if err := cp.client.ContainerRemove(ctx, con.ID, types.ContainerRemoveOptions{Force: true}); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to remove container %s: %v", con.ID, err)
+		}
+	}
+
+	if err := cp.client.Close(); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("failed to close Docker client: %v", err)
+	}
+	return firstErr
+}
+
+// ProcessFunc handles one routed item. A returned error counts as a failure for the
+// item's datafeed circuit breaker.
+type ProcessFunc func(ctx context.Context, data Data) error
+
+// DLQSink stores data that Route sheds instead of queueing
+type DLQSink interface {
+	Send(data Data) error
+}
+
 type TenantRouter struct {
 	channels        []chan Data
 	consistentHash  *consistent.Consistent
@@ -127,9 +160,38 @@ type TenantRouter struct {
 	mu              sync.RWMutex
 	workerPools     []*pond.WorkerPool
 	containerPool   *ContainerPool
+	process         ProcessFunc
+
+	dlqSink       DLQSink
+	shedThreshold int
+
+	// stopMu guards stopped and is held by Route while sending, so Stop never closes a
+	// channel under a pending send. stop is closed before Stop takes stopMu, which
+	// releases a Route blocked on a full channel.
+	stopMu   sync.RWMutex
+	stopped  bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
 }
 
+// NewTenantRouter creates a router that processes data by exchanging JSON lines with
+// containers from a pool of containerPoolSize containers running imageName.
 func NewTenantRouter(numChannels, workersPerChannel, containerPoolSize int, imageName string) (*TenantRouter, error) {
+	containerPool, err := NewContainerPool(containerPoolSize, imageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container pool: %v", err)
+	}
+
+	tr := NewTenantRouterWithProcessor(numChannels, workersPerChannel, nil)
+	tr.containerPool = containerPool
+	tr.process = tr.processInContainer
+	return tr, nil
+}
+
+// NewTenantRouterWithProcessor creates a router that hands each item to process and
+// needs no containers.
+func NewTenantRouterWithProcessor(numChannels, workersPerChannel int, process ProcessFunc) *TenantRouter {
 	cfg := consistent.Config{
 		PartitionCount:    271,
 		ReplicationFactor: 20,
@@ -149,41 +211,50 @@ func NewTenantRouter(numChannels, workersPerChannel, containerPoolSize int, imag
 
 	ring := consistent.New(members, cfg)
 
-	containerPool, err := NewContainerPool(containerPoolSize, imageName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create container pool: %v", err)
-	}
-
 	return &TenantRouter{
 		channels:       channels,
 		consistentHash: ring,
 		datafeedStatus: make(map[string]*DatafeedStatus),
 		workerPools:    workerPools,
-		containerPool:  containerPool,
-	}, nil
+		process:        process,
+		stop:           make(chan struct{}),
+	}
+}
+
+// EnableShedToDLQ makes Route send data to sink instead of blocking once the target
+// channel holds threshold or more items
+func (tr *TenantRouter) EnableShedToDLQ(sink DLQSink, threshold int) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.dlqSink = sink
+	tr.shedThreshold = threshold
+}
+
+// channelIndex returns the index of the channel a ring member such as "channel-11" stands for
+func (tr *TenantRouter) channelIndex(member consistent.Member) (int, error) {
+	name := member.String()
+	index, err := strconv.Atoi(strings.TrimPrefix(name, "channel-"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid channel member %q: %v", name, err)
+	}
+	if index < 0 || index >= len(tr.channels) {
+		return 0, fmt.Errorf("channel member %q out of range for %d channels", name, len(tr.channels))
+	}
+	return index, nil
 }
 
 func (tr *TenantRouter) Route(data Data) {
 	key := data.Tenant + "-" + data.DatafeedID
 	member := tr.consistentHash.LocateKey([]byte(key))
-	channelIndex := int(member.(Member)[8] - '0')
-
-	tr.mu.RLock()
-	status, exists := tr.datafeedStatus[data.DatafeedID]
-	tr.mu.RUnlock()
-
-	if !exists {
-		status = &DatafeedStatus{
-			circuitBreaker: CircuitBreaker{
-				threshold: 5,
-				cooldown:  time.Minute,
-			},
-		}
-		tr.mu.Lock()
-		tr.datafeedStatus[data.DatafeedID] = status
-		tr.mu.Unlock()
+	channelIndex, err := tr.channelIndex(member)
+	if err != nil {
+		fmt.Printf("Error routing data for datafeed %s: %v\n", data.DatafeedID, err)
+		return
 	}
 
+	status := tr.getDatafeedStatus(data.DatafeedID)
+
 	status.mu.Lock()
 	defer status.mu.Unlock()
 
@@ -196,7 +267,60 @@ func (tr *TenantRouter) Route(data Data) {
 		}
 	}
 
-	tr.channels[channelIndex] <- data
+	tr.stopMu.RLock()
+	defer tr.stopMu.RUnlock()
+	if tr.stopped {
+		fmt.Printf("Dropping data for datafeed %s, router is stopped\n", data.DatafeedID)
+		return
+	}
+
+	channel := tr.channels[channelIndex]
+
+	tr.mu.RLock()
+	sink, threshold := tr.dlqSink, tr.shedThreshold
+	tr.mu.RUnlock()
+
+	if sink != nil && len(channel) >= threshold {
+		err := sink.Send(data)
+		if err == nil {
+			fmt.Printf("Channel %d overloaded, shed data for datafeed %s to DLQ\n", channelIndex, data.DatafeedID)
+			return
+		}
+		// Fall back to queueing so the data is not lost
+		fmt.Printf("Error sending data for datafeed %s to DLQ: %v\n", data.DatafeedID, err)
+	}
+
+	select {
+	case channel <- data:
+	case <-tr.stop:
+		fmt.Printf("Dropping data for datafeed %s, router stopped while the channel was full\n", data.DatafeedID)
+	}
+}
+
+// getDatafeedStatus returns the status for a datafeed, creating it if needed. The lookup
+// is repeated under the write lock so concurrent callers always share one status.
+func (tr *TenantRouter) getDatafeedStatus(datafeedID string) *DatafeedStatus {
+	tr.mu.RLock()
+	status, exists := tr.datafeedStatus[datafeedID]
+	tr.mu.RUnlock()
+	if exists {
+		return status
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if status, exists := tr.datafeedStatus[datafeedID]; exists {
+		return status
+	}
+	status = &DatafeedStatus{
+		circuitBreaker: CircuitBreaker{
+			threshold: 5,
+			cooldown:  time.Minute,
+		},
+	}
+	tr.datafeedStatus[datafeedID] = status
+	return status
 }
 
 func (tr *TenantRouter) ReportFailure(datafeedID string) {
@@ -216,46 +340,59 @@ func (tr *TenantRouter) ReportFailure(datafeedID string) {
 }
 
 func (tr *TenantRouter) processData(data Data, workerID int) {
+	if err := tr.process(context.Background(), data); err != nil {
+		fmt.Printf("Worker %d failed to process data for tenant %s, datafeed %s: %v\n", workerID, data.Tenant, data.DatafeedID, err)
+		tr.ReportFailure(data.DatafeedID)
+		return
+	}
+	fmt.Printf("Worker %d processed data for tenant %s, datafeed %s\n", workerID, data.Tenant, data.DatafeedID)
+}
+
+// processInContainer is the default ProcessFunc. It writes data as a JSON line to a
+// pooled container's stdin and reads one line of output back.
+func (tr *TenantRouter) processInContainer(ctx context.Context, data Data) error {
 	container := tr.containerPool.GetContainer()
 	defer tr.containerPool.ReleaseContainer(container)
 
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		fmt.Printf("Error marshaling data: %v\n", err)
-		return
+		return fmt.Errorf("error marshaling data: %v", err)
 	}
 
 	_, err = container.Stdin.Write(append(jsonData, '\n'))
 	if err != nil {
-		fmt.Printf("Error writing to container stdin: %v\n", err)
-		return
+		return fmt.Errorf("error writing to container stdin: %v", err)
 	}
 
 	scanner := bufio.NewScanner(container.Stdout)
-	if scanner.Scan() {
-		output := scanner.Text()
-		fmt.Printf("Worker %d processed data for tenant %s, datafeed %s: %s\n", workerID, data.Tenant, data.DatafeedID, output)
-	} else {
-		fmt.Printf("Error reading from container stdout: %v\n", scanner.Err())
-		tr.ReportFailure(data.DatafeedID)
+	if !scanner.Scan() {
+		return fmt.Errorf("error reading from container stdout: %v", scanner.Err())
 	}
+	fmt.Printf("Container %s output for datafeed %s: %s\n", container.ID, data.DatafeedID, scanner.Text())
+	return nil
 }
 
-func (tr *TenantRouter) startWorkers(done chan bool) {
+// startWorkers feeds each channel into its worker pool and starts work stealing between
+// pools. Call Stop to shut them down.
+func (tr *TenantRouter) startWorkers() {
 	for i, pool := range tr.workerPools {
+		tr.workers.Add(1)
 		go func(channelIndex int, workerPool *pond.WorkerPool) {
+			defer tr.workers.Done()
 			for data := range tr.channels[channelIndex] {
+				// Capture per iteration, the closure runs after the loop has moved on
+				data := data
 				workerPool.Submit(func() {
 					tr.processData(data, channelIndex)
 				})
 			}
-			workerPool.StopAndWait()
-			done <- true
 		}(i, pool)
 	}
 
 	// Work stealing
+	tr.workers.Add(1)
 	go func() {
+		defer tr.workers.Done()
 		for {
 			for i, pool := range tr.workerPools {
 				if pool.IdleWorkers() > 0 {
@@ -266,8 +403,10 @@ func (tr *TenantRouter) startWorkers(done chan bool) {
 								if !ok {
 									return
 								}
+								// Capture per iteration, the closure runs after the loop has moved on
+								data, workerID := data, i
 								pool.Submit(func() {
-									tr.processData(data, i)
+									tr.processData(data, workerID)
 								})
 							default:
 							}
@@ -275,11 +414,48 @@ func (tr *TenantRouter) startWorkers(done chan bool) {
 					}
 				}
 			}
-			time.Sleep(time.Millisecond * 10)
+			select {
+			case <-tr.stop:
+				return
+			case <-time.After(time.Millisecond * 10):
+			}
 		}
 	}()
 }
 
+// Stop closes the channels, lets the workers finish the data already queued, then removes
+// any pooled containers and closes the Docker client. Route drops data once Stop has been
+// called.
+func (tr *TenantRouter) Stop() error {
+	first := false
+	tr.stopOnce.Do(func() {
+		first = true
+		close(tr.stop)
+	})
+	if !first {
+		return nil
+	}
+
+	tr.stopMu.Lock()
+	tr.stopped = true
+	for _, ch := range tr.channels {
+		close(ch)
+	}
+	tr.stopMu.Unlock()
+
+	// Feeding and stealing goroutines exit once the channels are drained, after which
+	// nothing submits to the worker pools any more
+	tr.workers.Wait()
+	for _, pool := range tr.workerPools {
+		pool.StopAndWait()
+	}
+
+	if tr.containerPool == nil {
+		return nil
+	}
+	return tr.containerPool.Close()
+}
+
 func main() {
 	numChannels := 5
 	workersPerChannel := 3
@@ -292,8 +468,7 @@ func main() {
 		return
 	}
 
-	done := make(chan bool, numChannels)
-	router.startWorkers(done)
+	router.startWorkers()
 
 	// Simulate incoming data
 	tenants := []string{"A", "B", "C", "D", "E"}
@@ -308,11 +483,7 @@ func main() {
 		time.Sleep(time.Millisecond * 10)
 	}
 
-	for _, ch := range router.channels {
-		close(ch)
-	}
-
-	for i := 0; i < numChannels; i++ {
-		<-done
+	if err := router.Stop(); err != nil {
+		fmt.Printf("Error stopping router: %v\n", err)
 	}
 }
@@ -3,6 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -91,6 +94,82 @@ func TestTenantRouterRoute(t *testing.T) {
 	assert.Equal(t, data, receivedData)
 }
 
+// Test TenantRouter.Route with more than ten channels
+func TestTenantRouterRouteManyChannels(t *testing.T) {
+	router, _ := NewTenantRouter(12, 1, 1, "test-image")
+
+	for i := 0; i < 50; i++ {
+		data := Data{
+			Tenant:     fmt.Sprintf("tenant-%d", i),
+			DatafeedID: fmt.Sprintf("%d", i),
+			Info:       fmt.Sprintf("Info %d", i),
+		}
+
+		member := router.consistentHash.LocateKey([]byte(data.Tenant + "-" + data.DatafeedID))
+		index, err := router.channelIndex(member)
+		assert.NoError(t, err)
+		assert.True(t, index >= 0 && index < 12, "channel index %d out of range", index)
+
+		router.Route(data)
+
+		select {
+		case received := <-router.channels[index]:
+			assert.Equal(t, data, received)
+		default:
+			t.Fatalf("data for %s was not routed to channel %d (%s)", data.Tenant, index, member)
+		}
+	}
+}
+
+// Test TenantRouter.Route shedding to the DLQ when a channel is overloaded
+func TestTenantRouterRouteShedToDLQ(t *testing.T) {
+	router, _ := NewTenantRouter(3, 2, 5, "test-image")
+	sink := &fakeDLQSink{}
+	router.EnableShedToDLQ(sink, 2)
+
+	for i := 0; i < 5; i++ {
+		router.Route(Data{
+			Tenant:     "A",
+			DatafeedID: "1",
+			Info:       fmt.Sprintf("Info %d", i),
+		})
+	}
+
+	queued := 0
+	for _, ch := range router.channels {
+		queued += len(ch)
+	}
+
+	assert.Equal(t, 2, queued)
+	assert.Len(t, sink.data, 3)
+	assert.Equal(t, "Info 2", sink.data[0].Info)
+}
+
+// Test that concurrent routes for one datafeed share a single status
+func TestTenantRouterRouteConcurrentStatus(t *testing.T) {
+	router, _ := NewTenantRouter(3, 2, 5, "test-image")
+
+	const goroutines = 50
+	statuses := make([]*DatafeedStatus, goroutines)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			router.Route(Data{Tenant: "A", DatafeedID: "shared", Info: fmt.Sprintf("Info %d", i)})
+			statuses[i] = router.getDatafeedStatus("shared")
+		}(i)
+	}
+	wg.Wait()
+
+	router.mu.RLock()
+	assert.Len(t, router.datafeedStatus, 1)
+	router.mu.RUnlock()
+	for _, status := range statuses {
+		assert.Same(t, statuses[0], status)
+	}
+}
+
 // Test TenantRouter.ReportFailure
 func TestTenantRouterReportFailure(t *testing.T) {
 	router, _ := NewTenantRouter(3, 2, 5, "test-image")
@@ -149,6 +228,46 @@ func TestTenantRouterProcessData(t *testing.T) {
 	assert.Equal(t, data, receivedData)
 }
 
+// Test TenantRouter.processData with an injected processor
+func TestTenantRouterProcessDataWithProcessor(t *testing.T) {
+	processor := &fakeProcessor{}
+	router := NewTenantRouterWithProcessor(3, 2, processor.Process)
+	data := Data{
+		Tenant:     "A",
+		DatafeedID: "1",
+		Info:       "Test info",
+	}
+
+	router.processData(data, 0)
+
+	assert.Equal(t, []Data{data}, processor.calls)
+	router.mu.RLock()
+	assert.Empty(t, router.datafeedStatus)
+	router.mu.RUnlock()
+}
+
+// Test that processor errors trip the datafeed circuit breaker
+func TestTenantRouterProcessorFailureTripsCircuitBreaker(t *testing.T) {
+	processor := &fakeProcessor{err: errors.New("processing failed")}
+	router := NewTenantRouterWithProcessor(3, 2, processor.Process)
+	status := router.getDatafeedStatus("1")
+
+	for i := 0; i < 5; i++ {
+		router.processData(Data{Tenant: "A", DatafeedID: "1", Info: fmt.Sprintf("Info %d", i)}, 0)
+	}
+
+	status.mu.Lock()
+	assert.Equal(t, 5, status.circuitBreaker.failures)
+	status.mu.Unlock()
+	assert.Len(t, processor.calls, 5)
+
+	// The breaker is open, so further data is dropped instead of queued
+	router.Route(Data{Tenant: "A", DatafeedID: "1", Info: "dropped"})
+	for _, ch := range router.channels {
+		assert.Empty(t, ch)
+	}
+}
+
 // Test TenantRouter.Stop
 func TestTenantRouterStop(t *testing.T) {
 	mockClient := new(MockDockerClient)
@@ -179,6 +298,169 @@ func TestTenantRouterStop(t *testing.T) {
 	mockClient.AssertExpectations(t)
 }
 
+// Test TenantRouter.Stop with running workers
+func TestTenantRouterStopWithWorkers(t *testing.T) {
+	mockClient := new(MockDockerClient)
+	client.NewClientWithOpts = func(ops ...client.Opt) (*client.Client, error) {
+		return mockClient, nil
+	}
+
+	mockClient.On("ContainerCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(container.ContainerCreateCreatedBody{ID: "test-container"}, nil)
+	mockClient.On("ContainerStart", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("ContainerAttach", mock.Anything, mock.Anything, mock.Anything).
+		Return(types.HijackedResponse{}, nil)
+	mockClient.On("ContainerStop", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("ContainerRemove", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("Close").Return(nil)
+
+	router, _ := NewTenantRouter(3, 2, 5, "test-image")
+	router.startWorkers()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- router.Stop()
+	}()
+
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+
+	// Routing and stopping again after Stop must not panic
+	assert.NotPanics(t, func() {
+		router.Route(Data{Tenant: "A", DatafeedID: "1", Info: "late"})
+	})
+	assert.NoError(t, router.Stop())
+}
+
+// Test that Stop does not deadlock with a Route blocked on a full channel
+func TestTenantRouterStopWithBlockedRoute(t *testing.T) {
+	router := NewTenantRouterWithProcessor(1, 1, (&fakeProcessor{}).Process)
+	for i := 0; i < cap(router.channels[0]); i++ {
+		router.channels[0] <- Data{Tenant: "A", DatafeedID: "1", Info: fmt.Sprintf("Info %d", i)}
+	}
+
+	routed := make(chan struct{})
+	go func() {
+		defer close(routed)
+		router.Route(Data{Tenant: "A", DatafeedID: "1", Info: "blocked"})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- router.Stop()
+	}()
+
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop deadlocked with a blocked Route")
+	}
+	<-routed
+}
+
+// Test that every routed item is processed exactly once, including stolen ones
+func TestTenantRouterProcessesEachItemOnce(t *testing.T) {
+	mockClient := new(MockDockerClient)
+	client.NewClientWithOpts = func(ops ...client.Opt) (*client.Client, error) {
+		return mockClient, nil
+	}
+
+	mockClient.On("ContainerCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(container.ContainerCreateCreatedBody{ID: "test-container"}, nil)
+	mockClient.On("ContainerStart", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("ContainerAttach", mock.Anything, mock.Anything, mock.Anything).
+		Return(types.HijackedResponse{}, nil)
+	mockClient.On("ContainerStop", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("ContainerRemove", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("Close").Return(nil)
+
+	const items = 2000
+	router, _ := NewTenantRouter(4, 2, 4, "test-image")
+
+	recorder := &recordingStdin{seen: make(map[string]int)}
+	router.containerPool.containers = make(chan *DockerContainer, 4)
+	for i := 0; i < 4; i++ {
+		router.containerPool.containers <- &DockerContainer{
+			ID:     fmt.Sprintf("test-container-%d", i),
+			Stdin:  recorder,
+			Stdout: &mockReadWriteCloser{readData: []byte("ok\n")},
+		}
+	}
+
+	router.startWorkers()
+	for i := 0; i < items; i++ {
+		// Few tenants so some channels back up and the idle pools steal from them
+		router.Route(Data{
+			Tenant:     fmt.Sprintf("tenant-%d", i%3),
+			DatafeedID: fmt.Sprintf("%d", i%3),
+			Info:       fmt.Sprintf("Info %d", i),
+		})
+	}
+	assert.NoError(t, router.Stop())
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	assert.Len(t, recorder.seen, items)
+	for info, count := range recorder.seen {
+		assert.Equal(t, 1, count, "%s processed %d times", info, count)
+	}
+}
+
+// recordingStdin counts the data written to a container's stdin, keyed by Info
+type recordingStdin struct {
+	mu   sync.Mutex
+	seen map[string]int
+}
+
+func (r *recordingStdin) Write(p []byte) (int, error) {
+	var data Data
+	if err := json.Unmarshal(p[:len(p)-1], &data); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen[data.Info]++
+	return len(p), nil
+}
+
+func (r *recordingStdin) Close() error {
+	return nil
+}
+
+// fakeProcessor records the data it is given and fails with err when set
+type fakeProcessor struct {
+	mu    sync.Mutex
+	calls []Data
+	err   error
+}
+
+func (f *fakeProcessor) Process(ctx context.Context, data Data) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, data)
+	return f.err
+}
+
+// fakeDLQSink records data shed by the router
+type fakeDLQSink struct {
+	mu   sync.Mutex
+	data []Data
+}
+
+func (f *fakeDLQSink) Send(data Data) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = append(f.data, data)
+	return nil
+}
+
 // Mock ReadWriteCloser for testing
 type mockReadWriteCloser struct {
 	readData    []byte
@@ -5,6 +5,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
+	"net/http"
 	"orenctl/internal/app/helper"
 	"strings"
 	"time"
@@ -16,14 +18,25 @@ import (
 
 type IESClient interface {
 	Search(aliasName string, query helper.Map, size int) (helper.Map, error)
+	SearchContext(ctx context.Context, aliasName string, query helper.Map, size int) (helper.Map, error)
+	SearchAll(ctx context.Context, aliasName string, query helper.Map, pageSize int) ([]helper.Map, error)
 	BulkIndexDocuments(alias string, docs []interface{}) error
 	BulkIndexDocumentsWithRetry(alias string, docs []interface{}, retries int, retryInterval time.Duration) error
+	BulkIndexDocumentsWithBackoff(alias string, docs []interface{}, opts BackoffOptions) error
+	RolloverAlias(ctx context.Context, alias string, conditions map[string]interface{}) (bool, string, error)
+	Count(ctx context.Context, alias string, query helper.Map) (int64, error)
+	DeleteByQuery(ctx context.Context, alias string, query helper.Map, opts ...DeleteByQueryOption) (int64, error)
 }
 
 type ESClient struct {
 	Client *elasticsearch.Client
+
+	// bulkSem limits concurrent bulk requests, nil means unlimited
+	bulkSem chan struct{}
 }
 
+// NewClient creates an ESClient. elastic.bulk.max_concurrency caps the number of bulk
+// requests in flight at once; zero or unset leaves them unlimited.
 func NewClient(addresses []string) (*ESClient, error) {
 	cfg := elasticsearch.Config{
 		Addresses: addresses,
@@ -34,10 +47,32 @@ func NewClient(addresses []string) (*ESClient, error) {
 		return nil, err
 	}
 
-	return &ESClient{Client: es}, nil
+	return newESClient(es, viper.GetInt("elastic.bulk.max_concurrency")), nil
+}
+
+func newESClient(es *elasticsearch.Client, maxConcurrentBulk int) *ESClient {
+	client := &ESClient{Client: es}
+	if maxConcurrentBulk > 0 {
+		client.bulkSem = make(chan struct{}, maxConcurrentBulk)
+	}
+	return client
+}
+
+// acquireBulkSlot blocks until a bulk request may proceed and returns the release func
+func (c *ESClient) acquireBulkSlot() func() {
+	if c.bulkSem == nil {
+		return func() {}
+	}
+	c.bulkSem <- struct{}{}
+	return func() { <-c.bulkSem }
 }
 
 func (es *ESClient) Search(aliasName string, query helper.Map, size int) (helper.Map, error) {
+	return es.SearchContext(context.Background(), aliasName, query, size)
+}
+
+// SearchContext is Search with a context, canceling ctx aborts the request
+func (es *ESClient) SearchContext(ctx context.Context, aliasName string, query helper.Map, size int) (helper.Map, error) {
 	// Convert the query map to JSON
 	queryBody, err := json.Marshal(query)
 	if err != nil {
@@ -51,7 +86,7 @@ func (es *ESClient) Search(aliasName string, query helper.Map, size int) (helper
 		Size:  &size,
 	}
 
-	res, err := searchRequest.Do(context.Background(), es.Client)
+	res, err := searchRequest.Do(ctx, es.Client)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute search request: %w", err)
 	}
@@ -65,8 +100,238 @@ func (es *ESClient) Search(aliasName string, query helper.Map, size int) (helper
 	return result, nil
 }
 
+// Count returns the number of documents matching query. Only the query's "query" clause is
+// sent, so a Search body with size or sort can be reused as is.
+func (es *ESClient) Count(ctx context.Context, alias string, query helper.Map) (int64, error) {
+	body := helper.Map{}
+	if clause, ok := query["query"]; ok {
+		body["query"] = clause
+	}
+
+	queryBody, err := json.Marshal(body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal query: %w", err)
+	}
+
+	countRequest := esapi.CountRequest{
+		Index: []string{viper.GetString("elastic.event.prefix") + alias},
+		Body:  bytes.NewReader(queryBody),
+	}
+
+	res, err := countRequest.Do(ctx, es.Client)
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute count request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, fmt.Errorf("count request failed: %s", res.String())
+	}
+
+	var result struct {
+		Count *int64 `json:"count"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("failed to parse count response: %w", err)
+	}
+	if result.Count == nil {
+		return 0, fmt.Errorf("count response has no count field")
+	}
+
+	return *result.Count, nil
+}
+
+// DeleteByQueryOption adjusts a DeleteByQuery request
+type DeleteByQueryOption func(*esapi.DeleteByQueryRequest)
+
+// WithConflictsProceed keeps deleting when documents change during the request instead of
+// aborting on the first version conflict
+func WithConflictsProceed() DeleteByQueryOption {
+	return func(req *esapi.DeleteByQueryRequest) {
+		req.Conflicts = "proceed"
+	}
+}
+
+// DeleteByQuery deletes every document matching query and returns how many were deleted
+func (es *ESClient) DeleteByQuery(ctx context.Context, alias string, query helper.Map, opts ...DeleteByQueryOption) (int64, error) {
+	queryBody, err := json.Marshal(query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal query: %w", err)
+	}
+
+	deleteRequest := esapi.DeleteByQueryRequest{
+		Index: []string{viper.GetString("elastic.event.prefix") + alias},
+		Body:  bytes.NewReader(queryBody),
+	}
+	for _, opt := range opts {
+		opt(&deleteRequest)
+	}
+
+	res, err := deleteRequest.Do(ctx, es.Client)
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute delete by query request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, fmt.Errorf("delete by query failed: %s", res.String())
+	}
+
+	var result struct {
+		Deleted   int64         `json:"deleted"`
+		Failures  []interface{} `json:"failures"`
+		Conflicts int64         `json:"version_conflicts"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("failed to parse delete by query response: %w", err)
+	}
+	if len(result.Failures) > 0 {
+		return result.Deleted, fmt.Errorf("delete by query deleted %d documents with %d failures: %v", result.Deleted, len(result.Failures), result.Failures)
+	}
+
+	return result.Deleted, nil
+}
+
+// pitKeepAlive is how long a point in time used by SearchAll stays open between pages
+const pitKeepAlive = "1m"
+
+// SearchAll returns every hit matching query, fetching pageSize hits per request with
+// search_after over a point in time. The query's sort is kept if it has one, otherwise
+// hits are sorted by _shard_doc.
+func (es *ESClient) SearchAll(ctx context.Context, aliasName string, query helper.Map, pageSize int) ([]helper.Map, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("page size must be positive, got %d", pageSize)
+	}
+
+	pitID, err := es.openPointInTime(ctx, viper.GetString("elastic.event.prefix")+aliasName)
+	if err != nil {
+		return nil, err
+	}
+	// pitID may be replaced by a later page, close whichever is current
+	defer func() { es.closePointInTime(pitID) }()
+
+	body := make(helper.Map, len(query)+4)
+	for key, value := range query {
+		body[key] = value
+	}
+	if _, ok := body["sort"]; !ok {
+		body["sort"] = []interface{}{helper.Map{"_shard_doc": "asc"}}
+	}
+	body["size"] = pageSize
+
+	var docs []helper.Map
+	for {
+		body["pit"] = helper.Map{"id": pitID, "keep_alive": pitKeepAlive}
+
+		page, err := es.searchPage(ctx, body)
+		if err != nil {
+			return nil, err
+		}
+		if id, ok := page["pit_id"].(string); ok && id != "" {
+			pitID = id
+		}
+
+		hits, err := extractHits(page)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, hits...)
+		if len(hits) < pageSize {
+			return docs, nil
+		}
+
+		sortValues, ok := hits[len(hits)-1]["sort"]
+		if !ok {
+			return nil, fmt.Errorf("search hit has no sort values to continue from")
+		}
+		body["search_after"] = sortValues
+	}
+}
+
+func (es *ESClient) searchPage(ctx context.Context, body helper.Map) (helper.Map, error) {
+	queryBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal query: %w", err)
+	}
+
+	// A point in time search must not name an index
+	res, err := esapi.SearchRequest{Body: bytes.NewReader(queryBody)}.Do(ctx, es.Client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute search request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("search request failed: %s", res.String())
+	}
+
+	var result helper.Map
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse search results: %w", err)
+	}
+	return result, nil
+}
+
+func extractHits(result helper.Map) ([]helper.Map, error) {
+	outer, ok := result["hits"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("search response has no hits")
+	}
+	rawHits, ok := outer["hits"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("search response has no hits")
+	}
+
+	hits := make([]helper.Map, 0, len(rawHits))
+	for _, raw := range rawHits {
+		hit, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected search hit of type %T", raw)
+		}
+		hits = append(hits, helper.Map(hit))
+	}
+	return hits, nil
+}
+
+func (es *ESClient) openPointInTime(ctx context.Context, index string) (string, error) {
+	res, err := es.Client.OpenPointInTime(
+		[]string{index},
+		pitKeepAlive,
+		es.Client.OpenPointInTime.WithContext(ctx),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to open point in time: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return "", fmt.Errorf("failed to open point in time: %s", res.String())
+	}
+
+	var pit struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&pit); err != nil {
+		return "", fmt.Errorf("failed to decode point in time response: %w", err)
+	}
+	return pit.ID, nil
+}
+
+func (es *ESClient) closePointInTime(pitID string) {
+	body, _ := json.Marshal(helper.Map{"id": pitID})
+	res, err := es.Client.ClosePointInTime(es.Client.ClosePointInTime.WithBody(bytes.NewReader(body)))
+	if err != nil {
+		fmt.Printf("Failed to close point in time: %v\n", err)
+		return
+	}
+	res.Body.Close()
+}
+
 // BulkIndexDocuments indexes multiple documents using the alias
 func (c *ESClient) BulkIndexDocuments(alias string, docs []interface{}) error {
+	release := c.acquireBulkSlot()
+	defer release()
+
 	// First, get the write index for the alias
 	writeIndex, err := c.getWriteIndexForAlias(alias)
 	if err != nil {
@@ -104,13 +369,53 @@ func (c *ESClient) BulkIndexDocuments(alias string, docs []interface{}) error {
 		return err
 	}
 
-	if bulkResponse["errors"].(bool) {
+	hasErrors, ok := bulkResponse["errors"].(bool)
+	if !ok {
+		return fmt.Errorf("bulk response has no errors flag: %v", bulkResponse)
+	}
+	if hasErrors {
 		return fmt.Errorf("bulk indexing encountered errors: %v", bulkResponse)
 	}
 
 	return nil
 }
 
+// RolloverAlias rolls the alias over to a new write index when any of conditions, such as
+// max_age, max_docs or max_size, is met. With no conditions the rollover is unconditional.
+// It returns whether a rollover happened and the name of the new index.
+func (c *ESClient) RolloverAlias(ctx context.Context, alias string, conditions map[string]interface{}) (bool, string, error) {
+	opts := []func(*esapi.IndicesRolloverRequest){
+		c.Client.Indices.Rollover.WithContext(ctx),
+	}
+	if len(conditions) > 0 {
+		body, err := json.Marshal(map[string]interface{}{"conditions": conditions})
+		if err != nil {
+			return false, "", fmt.Errorf("failed to marshal rollover conditions: %w", err)
+		}
+		opts = append(opts, c.Client.Indices.Rollover.WithBody(bytes.NewReader(body)))
+	}
+
+	res, err := c.Client.Indices.Rollover(viper.GetString("elastic.event.prefix")+alias, opts...)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to execute rollover request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return false, "", fmt.Errorf("rollover failed: %s", res.String())
+	}
+
+	var rollover struct {
+		RolledOver bool   `json:"rolled_over"`
+		NewIndex   string `json:"new_index"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rollover); err != nil {
+		return false, "", fmt.Errorf("failed to parse rollover response: %w", err)
+	}
+
+	return rollover.RolledOver, rollover.NewIndex, nil
+}
+
 // getWriteIndexForAlias gets the current write index for an alias
 func (c *ESClient) getWriteIndexForAlias(alias string) (string, error) {
 	aliasName := viper.GetString("elastic.event.prefix") + alias
@@ -122,6 +427,10 @@ func (c *ESClient) getWriteIndexForAlias(alias string) (string, error) {
 	}
 	defer res.Body.Close()
 
+	if res.IsError() {
+		return "", fmt.Errorf("failed to get alias info: %s", res.String())
+	}
+
 	var aliasResponse map[string]interface{}
 	if err := json.NewDecoder(res.Body).Decode(&aliasResponse); err != nil {
 		return "", fmt.Errorf("failed to decode alias response: %w", err)
@@ -129,32 +438,173 @@ func (c *ESClient) getWriteIndexForAlias(alias string) (string, error) {
 
 	// Find the write index
 	for indexName, indexData := range aliasResponse {
-		if indexInfo, ok := indexData.(map[string]interface{})["aliases"].(map[string]interface{})[aliasName]; ok {
-			if writeIndex, ok := indexInfo.(map[string]interface{})["is_write_index"]; ok && writeIndex.(bool) {
-				return indexName, nil
-			}
+		indexMap, ok := indexData.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("malformed alias response for index %s: expected an object, got %T", indexName, indexData)
+		}
+		aliases, ok := indexMap["aliases"].(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("malformed alias response for index %s: missing aliases object", indexName)
+		}
+		indexInfo, ok := aliases[aliasName].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if isWriteIndex, ok := indexInfo["is_write_index"].(bool); ok && isWriteIndex {
+			return indexName, nil
 		}
 	}
 
 	return "", fmt.Errorf("no write index found for alias %s", aliasName)
 }
 
+// BulkIndexResult reports the outcome of a bulk index with retries
+type BulkIndexResult struct {
+	Indexed int
+	Failed  []FailedDocument
+}
+
+// FailedDocument is a document that could not be indexed. Status is the HTTP status of
+// its bulk item, or zero when the whole request failed.
+type FailedDocument struct {
+	Document interface{}
+	Status   int
+	Error    string
+}
+
 func (c *ESClient) BulkIndexDocumentsWithRetry(alias string, docs []interface{}, retries int, retryInterval time.Duration) error {
-	var err error
+	result, err := c.BulkIndexDocumentsWithRetryResult(alias, docs, retries, retryInterval)
+	if err != nil {
+		return err
+	}
+	return result.err(retries)
+}
 
-	for attempt := 0; attempt < retries; attempt++ {
-		if err = c.bulkIndex(alias, docs); err == nil {
-			return nil
+// BulkIndexDocumentsWithRetryResult retries only the documents whose bulk items failed with
+// a retryable status, and reports documents that failed permanently or ran out of retries.
+// The error is only set if the request could not be built.
+func (c *ESClient) BulkIndexDocumentsWithRetryResult(alias string, docs []interface{}, retries int, retryInterval time.Duration) (BulkIndexResult, error) {
+	return c.bulkIndexWithRetries(alias, docs, retries, func(int) time.Duration {
+		return retryInterval
+	})
+}
+
+// BackoffOptions controls the delay between BulkIndexDocumentsWithBackoff attempts.
+// The delay starts at InitialInterval, is multiplied by Multiplier after every failed
+// attempt and never exceeds MaxInterval. Jitter is the fraction, from 0 to 1, of each
+// delay that is randomized so workers retrying together spread out.
+type BackoffOptions struct {
+	Retries         int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	Jitter          float64
+}
+
+func (c *ESClient) BulkIndexDocumentsWithBackoff(alias string, docs []interface{}, opts BackoffOptions) error {
+	result, err := c.bulkIndexWithRetries(alias, docs, opts.Retries, func(attempt int) time.Duration {
+		return backoffDelay(opts, attempt, rand.Float64())
+	})
+	if err != nil {
+		return err
+	}
+	return result.err(opts.Retries)
+}
+
+func (r BulkIndexResult) err(retries int) error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("bulk indexing failed after %d retries: %d documents not indexed, first error: %s", retries, len(r.Failed), r.Failed[0].Error)
+}
+
+// bulkIndexWithRetries indexes docs, resending only retryable failures. delay returns the
+// wait after the given zero-based attempt.
+func (c *ESClient) bulkIndexWithRetries(alias string, docs []interface{}, retries int, delay func(attempt int) time.Duration) (BulkIndexResult, error) {
+	var result BulkIndexResult
+	pending := make([]FailedDocument, len(docs))
+	for i, doc := range docs {
+		pending[i] = FailedDocument{Document: doc, Error: "not attempted"}
+	}
+
+	for attempt := 0; attempt < retries && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			wait := delay(attempt - 1)
+			fmt.Printf("Bulk indexing failed (attempt %d/%d). Retrying %d documents in %v...\n", attempt, retries, len(pending), wait)
+			time.Sleep(wait)
+		}
+
+		batch := make([]interface{}, len(pending))
+		for i, p := range pending {
+			batch[i] = p.Document
+		}
+
+		failures, err := c.bulkIndex(alias, batch)
+		if err != nil {
+			for i := range pending {
+				pending[i].Status = 0
+				pending[i].Error = err.Error()
+			}
+			continue
+		}
+
+		var retry []FailedDocument
+		result.Indexed += len(batch) - len(failures)
+		for _, f := range failures {
+			failed := FailedDocument{Document: batch[f.position], Status: f.status, Error: f.reason}
+			if isRetryableBulkStatus(f.status) {
+				retry = append(retry, failed)
+			} else {
+				result.Failed = append(result.Failed, failed)
+			}
+		}
+		pending = retry
+	}
+
+	result.Failed = append(result.Failed, pending...)
+	return result, nil
+}
+
+// isRetryableBulkStatus reports whether a bulk item failure may succeed if resent
+func isRetryableBulkStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// backoffDelay returns the delay after the given zero-based attempt. random is a value
+// in [0, 1) that removes up to opts.Jitter of the delay.
+func backoffDelay(opts BackoffOptions, attempt int, random float64) time.Duration {
+	multiplier := opts.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(opts.InitialInterval)
+	for i := 0; i < attempt; i++ {
+		delay *= multiplier
+		if opts.MaxInterval > 0 && delay >= float64(opts.MaxInterval) {
+			break
 		}
+	}
+	if opts.MaxInterval > 0 && delay > float64(opts.MaxInterval) {
+		delay = float64(opts.MaxInterval)
+	}
 
-		fmt.Printf("Bulk indexing failed (attempt %d/%d). Retrying in %v...\n", attempt+1, retries, retryInterval)
-		time.Sleep(retryInterval)
+	if opts.Jitter > 0 {
+		delay -= delay * opts.Jitter * random
 	}
+	return time.Duration(delay)
+}
 
-	return fmt.Errorf("bulk indexing failed after %d retries: %v", retries, err)
+// bulkItemFailure is a failed item of a bulk response, position is its index in the request
+type bulkItemFailure struct {
+	position int
+	status   int
+	reason   string
 }
 
-func (c *ESClient) bulkIndex(alias string, docs []interface{}) (err error) {
+// bulkIndex sends docs in one bulk request and returns the items that failed. An error
+// means the request as a whole failed.
+func (c *ESClient) bulkIndex(alias string, docs []interface{}) (failures []bulkItemFailure, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Printf("Recovered from panic: %v", r)
@@ -162,26 +612,29 @@ func (c *ESClient) bulkIndex(alias string, docs []interface{}) (err error) {
 		}
 	}()
 
+	release := c.acquireBulkSlot()
+	defer release()
+
 	// Get the write index for the alias
 	writeIndex, err := c.getWriteIndexForAlias(alias)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var buf bytes.Buffer
 	for _, doc := range docs {
 		if err = c.encodeActionAndDocument(&buf, writeIndex, doc); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	res, err := c.Client.Bulk(bytes.NewReader(buf.Bytes()))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer res.Body.Close()
 
-	return c.handleBulkResponse(res)
+	return c.handleBulkResponse(res, len(docs))
 }
 
 func (c *ESClient) encodeActionAndDocument(buf *bytes.Buffer, writeIndex string, doc interface{}) error {
@@ -197,19 +650,40 @@ func (c *ESClient) encodeActionAndDocument(buf *bytes.Buffer, writeIndex string,
 	return json.NewEncoder(buf).Encode(doc)
 }
 
-func (c *ESClient) handleBulkResponse(res *esapi.Response) error {
+func (c *ESClient) handleBulkResponse(res *esapi.Response, sent int) ([]bulkItemFailure, error) {
 	if res.IsError() {
-		return fmt.Errorf("bulk indexing failed: %s", res.Status())
+		return nil, fmt.Errorf("bulk indexing failed: %s", res.Status())
 	}
 
-	var bulkResponse map[string]interface{}
+	var bulkResponse struct {
+		// A pointer so a response without the flag is not mistaken for full success
+		Errors *bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
 	if err := json.NewDecoder(res.Body).Decode(&bulkResponse); err != nil {
-		return err
+		return nil, err
 	}
 
-	if bulkResponse["errors"].(bool) {
-		return fmt.Errorf("bulk indexing failed: errors in response")
+	if bulkResponse.Errors == nil {
+		return nil, fmt.Errorf("bulk response has no errors flag")
+	}
+	if !*bulkResponse.Errors {
+		return nil, nil
+	}
+	if len(bulkResponse.Items) != sent {
+		return nil, fmt.Errorf("bulk indexing failed: got %d items for %d documents", len(bulkResponse.Items), sent)
 	}
 
-	return nil
+	var failures []bulkItemFailure
+	for i, item := range bulkResponse.Items {
+		for _, result := range item {
+			if result.Status >= http.StatusMultipleChoices {
+				failures = append(failures, bulkItemFailure{position: i, status: result.Status, reason: string(result.Error)})
+			}
+		}
+	}
+	return failures, nil
 }
\ No newline at end of file
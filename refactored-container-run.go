@@ -1,12 +1,13 @@
 package container
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
-	"github.com/imdario/mergo"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
 
 	"your-project/logger"
@@ -21,18 +22,103 @@ type OutputContainer struct {
 	ErrMessage  string                 `json:"err_message,omitempty"`
 }
 
+var (
+	// ErrInvalidJobContext is returned when the job context is not a JSON object
+	ErrInvalidJobContext = errors.New("invalid job context")
+	// ErrMissingJobField is returned when a required job context field is empty or missing
+	ErrMissingJobField = errors.New("missing job context field")
+	// ErrRunTimeout is returned when a job does not complete within its execution timeout
+	ErrRunTimeout = errors.New("container run timed out")
+)
+
+const defaultRunTimeout = 10 * time.Minute
+
+// stopGracePeriod bounds how long a timed out run waits for the output loop to exit after
+// the container is stopped
+var stopGracePeriod = 5 * time.Second
+
+// JobContext is the typed view of the DatafeedJob context sent to a container.
+// Raw keeps every field so the context can be forwarded unchanged.
+type JobContext struct {
+	JobID  string
+	Tenant string
+	// Timeout is the optional "timeout" field in seconds, zero when not set
+	Timeout time.Duration
+	Raw     map[string]interface{}
+}
+
+// ParseJobContext parses a job context, wrapping ErrInvalidJobContext or ErrMissingJobField
+// so callers can handle failures the same way with errors.Is.
+func ParseJobContext(context string) (JobContext, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(context), &raw); err != nil {
+		return JobContext{}, fmt.Errorf("%w: %v", ErrInvalidJobContext, err)
+	}
+	if raw == nil {
+		return JobContext{}, fmt.Errorf("%w: context is null", ErrInvalidJobContext)
+	}
+
+	jobCtx := JobContext{Raw: raw}
+	for field, dst := range map[string]*string{"job_id": &jobCtx.JobID, "tenant": &jobCtx.Tenant} {
+		value, ok := raw[field].(string)
+		if !ok || value == "" {
+			return JobContext{}, fmt.Errorf("%w: %s", ErrMissingJobField, field)
+		}
+		*dst = value
+	}
+	if timeout, ok := raw["timeout"].(float64); ok && timeout > 0 {
+		jobCtx.Timeout = time.Duration(timeout * float64(time.Second))
+	}
+
+	return jobCtx, nil
+}
+
+// Decode decodes the full context into v, for callers that need more than the typed fields
+func (j JobContext) Decode(v interface{}) error {
+	data, err := json.Marshal(j.Raw)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJobContext, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJobContext, err)
+	}
+	return nil
+}
+
+// runTimeout returns how long a job may run, from the job context or else
+// worker.container_run_timeout.
+func runTimeout(jobCtx JobContext) time.Duration {
+	if jobCtx.Timeout > 0 {
+		return jobCtx.Timeout
+	}
+	if timeout := viper.GetDuration("worker.container_run_timeout"); timeout > 0 {
+		return timeout
+	}
+	return defaultRunTimeout
+}
+
 func (c *Container) Run(name, context string, args map[string]interface{}, requestID, taskID string) (output.Output, error) {
 	taskLog := logger.With(zap.String("RequestID", requestID), zap.String("task-id", taskID))
 	taskLog.Info("Run container", zap.Any("container", c))
 
+	// Reject a bad context before it reaches the container
+	jobCtx, err := ParseJobContext(context)
+	if err != nil {
+		taskLog.Error("Invalid job context", zap.Error(err))
+		return CreateContainerErrorOutput(name, args, requestID, taskID, err), nil
+	}
+
 	if err := c.prepareContainer(context); err != nil {
 		return output.Output{}, err
 	}
 
-	jobInfo := c.parseJobInfo(context)
 	defaultResult := c.initializeDefaultResult()
 
-	outputResult, err := c.processContainerOutput(taskLog, jobInfo, defaultResult)
+	outputResult, err := c.awaitContainerOutput(taskLog, jobCtx, defaultResult, runTimeout(jobCtx))
+	if errors.Is(err, ErrRunTimeout) {
+		taskLog.Error("Container run timed out", zap.Error(err))
+		return CreateContainerErrorOutput(name, args, requestID, taskID, err), nil
+	}
 	if err != nil {
 		return output.Output{}, err
 	}
@@ -59,12 +145,6 @@ func (c *Container) prepareContainer(context string) error {
 	return nil
 }
 
-func (c *Container) parseJobInfo(context string) map[string]interface{} {
-	var jobInfo map[string]interface{}
-	_ = json.Unmarshal([]byte(context), &jobInfo)
-	return jobInfo
-}
-
 func (c *Container) initializeDefaultResult() map[string]interface{} {
 	return map[string]interface{}{
 		"Type":           -1,
@@ -73,34 +153,90 @@ func (c *Container) initializeDefaultResult() map[string]interface{} {
 	}
 }
 
-func (c *Container) processContainerOutput(taskLog *zap.Logger, jobInfo, defaultResult map[string]interface{}) (interface{}, error) {
+// awaitContainerOutput runs processContainerOutput, giving up with ErrRunTimeout once
+// timeout has passed. On timeout it stops the container and waits up to stopGracePeriod for
+// the scan loop to exit, so nothing from this job touches the container once it is reused.
+func (c *Container) awaitContainerOutput(taskLog *zap.Logger, jobCtx JobContext, defaultResult map[string]interface{}, timeout time.Duration) (interface{}, error) {
+	type processed struct {
+		outputResult interface{}
+		err          error
+	}
+	// Capture the scanner here, a restart replaces c.Stdout
+	stdout := c.Stdout
+	cancel := make(chan struct{})
+	finished := make(chan processed, 1)
+	go func() {
+		outputResult, err := c.processContainerOutput(stdout, cancel, taskLog, jobCtx, defaultResult)
+		finished <- processed{outputResult, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-finished:
+		return result.outputResult, result.err
+	case <-timer.C:
+		close(cancel)
+		// Stopping the container closes stdout, which unblocks a pending Scan
+		_ = c.StopContainer()
+
+		grace := time.NewTimer(stopGracePeriod)
+		defer grace.Stop()
+		select {
+		case <-finished:
+			return nil, fmt.Errorf("%w after %s", ErrRunTimeout, timeout)
+		case <-grace.C:
+			taskLog.Error("Container output still open after stop", zap.Duration("grace", stopGracePeriod))
+			return nil, fmt.Errorf("%w after %s, output did not close within %s of stopping the container", ErrRunTimeout, timeout, stopGracePeriod)
+		}
+	}
+}
+
+// processContainerOutput reads protocol messages from stdout until "completed", EOF or
+// cancel is closed.
+func (c *Container) processContainerOutput(stdout *bufio.Scanner, cancel <-chan struct{}, taskLog *zap.Logger, jobCtx JobContext, defaultResult map[string]interface{}) (interface{}, error) {
 	var outputResult interface{}
 
-	for c.Stdout.Scan() {
-		out := c.Stdout.Text()
-		taskLog.Info("Task output", zap.String("task", jobInfo["job_id"].(string)), zap.String("result", out))
+	for stdout.Scan() {
+		select {
+		case <-cancel:
+			return nil, ErrRunTimeout
+		default:
+		}
+
+		out := stdout.Text()
+		taskLog.Info("Task output", zap.String("task", jobCtx.JobID), zap.String("result", out))
 
 		var outputContainer OutputContainer
 		if err := json.Unmarshal([]byte(out), &outputContainer); err != nil {
-			taskLog.Error("Cannot parse output", zap.String("output", out), zap.Error(err))
+			// Plain prints from user scripts are not protocol messages but still worth showing
+			c.handleRawOutput(out, jobCtx, cancel)
 			continue
 		}
 
-		outputResult = c.handleOutputType(outputContainer, defaultResult, jobInfo, taskLog)
+		outputResult = c.handleOutputType(outputContainer, defaultResult, jobCtx, taskLog, cancel)
 		if outputContainer.Type == "completed" {
 			break
 		}
 	}
 
+	if err := stdout.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("container output line exceeds worker.max_output_bytes: %w", err)
+		}
+		return nil, fmt.Errorf("error reading container output: %w", err)
+	}
+
 	return outputResult, nil
 }
 
-func (c *Container) handleOutputType(outputContainer OutputContainer, defaultResult, jobInfo map[string]interface{}, taskLog *zap.Logger) interface{} {
+func (c *Container) handleOutputType(outputContainer OutputContainer, defaultResult map[string]interface{}, jobCtx JobContext, taskLog *zap.Logger, cancel <-chan struct{}) interface{} {
 	switch outputContainer.Type {
 	case "result":
 		return c.handleResultOutput(outputContainer, defaultResult)
 	case "log":
-		return c.handleLogOutput(outputContainer, jobInfo, taskLog)
+		return c.handleLogOutput(outputContainer, jobCtx, taskLog, cancel)
 	case "exception", "error":
 		return c.handleErrorOutput(outputContainer)
 	case "ignored_exception":
@@ -131,29 +267,70 @@ func (c *Container) handleResultOutput(outputContainer OutputContainer, defaultR
 
 func (c *Container) mergeFetchedData(content map[string]interface{}, newFetchedData interface{}) {
 	if existingFetchedData, ok := content["fetched_data"]; ok {
-		_ = mergo.Merge(&existingFetchedData, newFetchedData)
-		if sliceData, ok := existingFetchedData.([]interface{}); ok {
-			if newSliceData, ok := newFetchedData.([]interface{}); ok {
-				content["fetched_data"] = append(sliceData, newSliceData...)
-			}
-		}
+		content["fetched_data"] = mergeFetchedValue(existingFetchedData, newFetchedData)
 	} else {
 		content["fetched_data"] = newFetchedData
 	}
 }
 
-func (c *Container) handleLogOutput(outputContainer OutputContainer, jobInfo map[string]interface{}, taskLog *zap.Logger) map[string]interface{} {
+// mergeFetchedValue appends slices in output order and deep-merges maps. Values of any other
+// or of mismatched shapes are replaced by incoming.
+func mergeFetchedValue(existing, incoming interface{}) interface{} {
+	switch existingValue := existing.(type) {
+	case []interface{}:
+		if incomingValue, ok := incoming.([]interface{}); ok {
+			merged := make([]interface{}, 0, len(existingValue)+len(incomingValue))
+			merged = append(merged, existingValue...)
+			return append(merged, incomingValue...)
+		}
+	case map[string]interface{}:
+		if incomingValue, ok := incoming.(map[string]interface{}); ok {
+			for key, value := range incomingValue {
+				if current, ok := existingValue[key]; ok {
+					existingValue[key] = mergeFetchedValue(current, value)
+				} else {
+					existingValue[key] = value
+				}
+			}
+			return existingValue
+		}
+	}
+	return incoming
+}
+
+func (c *Container) handleLogOutput(outputContainer OutputContainer, jobCtx JobContext, taskLog *zap.Logger, cancel <-chan struct{}) map[string]interface{} {
 	log := map[string]interface{}{
 		"Type":     4,
 		"Contents": outputContainer.Message,
-		"JobID":    jobInfo["job_id"],
-		"Tenant":   jobInfo["tenant"],
+		"JobID":    jobCtx.JobID,
+		"Tenant":   jobCtx.Tenant,
 	}
-	c.LogChan <- log
+	c.sendLog(log, cancel)
 	taskLog.Info("Container log", zap.String("message", outputContainer.Message), zap.Any("chan", c.LogChan))
 	return nil
 }
 
+// handleRawOutput forwards a stdout line that is not a protocol message as a log entry
+// flagged Raw.
+func (c *Container) handleRawOutput(out string, jobCtx JobContext, cancel <-chan struct{}) {
+	c.sendLog(map[string]interface{}{
+		"Type":     4,
+		"Contents": out,
+		"JobID":    jobCtx.JobID,
+		"Tenant":   jobCtx.Tenant,
+		"Raw":      true,
+	}, cancel)
+}
+
+// sendLog sends log to LogChan, giving up once cancel is closed so a timed-out run
+// cannot block on a log channel nobody reads any more
+func (c *Container) sendLog(log map[string]interface{}, cancel <-chan struct{}) {
+	select {
+	case c.LogChan <- log:
+	case <-cancel:
+	}
+}
+
 func (c *Container) handleErrorOutput(outputContainer OutputContainer) map[string]interface{} {
 	return map[string]interface{}{
 		"Type":     2,
@@ -8,6 +8,7 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 
+	"your-project/container"
 	"your-project/helpers"
 	"your-project/kafka"
 	"your-project/output"
@@ -36,12 +37,16 @@ func (h *JobHandlers) RunDatafeed(name, context string, args map[string]interfac
 }
 
 func (h *JobHandlers) parseJobInfo(context string) (helpers.Job, error) {
-	var jobInfo helpers.Job
-	err := json.Unmarshal([]byte(context), &jobInfo)
+	jobCtx, err := container.ParseJobContext(context)
 	if err != nil {
 		return helpers.Job{}, err
 	}
-	tenants <- jobInfo.Tenant
+
+	var jobInfo helpers.Job
+	if err := jobCtx.Decode(&jobInfo); err != nil {
+		return helpers.Job{}, err
+	}
+	tenants <- jobCtx.Tenant
 	return jobInfo, nil
 }
 
@@ -3,45 +3,118 @@ package reader
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"testing"
 )
 
+// defaultMaxFrameSize bounds a single Docker frame when maxFrameSize is not set
+const defaultMaxFrameSize = 16 * 1024 * 1024
+
+// rawStreamType is the stream type ReadMessage reports for a non-multiplexed stream
+const rawStreamType byte = 1
+
+// rawChunkSize is how much ReadMessage reads at a time from a non-multiplexed stream
+const rawChunkSize = 32 * 1024
+
 type adaptiveReader struct {
-	reader io.Reader
-	buffer []byte
+	reader     io.Reader
+	buffer     []byte
+	bufferType byte
+
+	// maxFrameSize is the largest frame payload accepted, zero means defaultMaxFrameSize
+	maxFrameSize int
+
+	// raw is set once the stream turns out not to be Docker multiplexed (TTY mode),
+	// after which everything is passed through unchanged
+	raw bool
 }
 
 func (ar *adaptiveReader) Read(p []byte) (int, error) {
+	// Skip empty frames, returning 0, nil for one would look like a stalled stream
+	for len(ar.buffer) == 0 {
+		if ar.raw {
+			return ar.reader.Read(p)
+		}
+
+		data, streamType, err := ar.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+		ar.buffer, ar.bufferType = data, streamType
+	}
+
+	n := copy(p, ar.buffer)
+	ar.buffer = ar.buffer[n:]
+	return n, nil
+}
+
+// ReadMessage returns the whole payload of the next frame and its stream type. If a
+// previous Read consumed part of a frame, the rest of that frame is returned. For a
+// non-multiplexed stream it returns the next chunk read, reported as rawStreamType.
+func (ar *adaptiveReader) ReadMessage() ([]byte, byte, error) {
 	if len(ar.buffer) > 0 {
-		n := copy(p, ar.buffer)
-		ar.buffer = ar.buffer[n:]
-		return n, nil
+		data := ar.buffer
+		ar.buffer = nil
+		return data, ar.bufferType, nil
+	}
+	return ar.nextFrame()
+}
+
+func (ar *adaptiveReader) nextFrame() ([]byte, byte, error) {
+	if ar.raw {
+		chunk := make([]byte, rawChunkSize)
+		for {
+			n, err := ar.reader.Read(chunk)
+			if n > 0 {
+				return chunk[:n], rawStreamType, nil
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+		}
 	}
 
 	header := make([]byte, 8)
-	_, err := io.ReadFull(ar.reader, header)
+	n, err := io.ReadFull(ar.reader, header)
+	if err == io.ErrUnexpectedEOF {
+		// Too short to be a header, treat it as raw data
+		ar.raw = true
+		return header[:n], rawStreamType, nil
+	}
 	if err != nil {
-		return 0, err
+		return nil, 0, err
 	}
 
-	// Only handle Docker stream headers
-	if header[0] != 1 && header[0] != 2 {
-		return 0, io.ErrUnexpectedEOF
+	if !isDockerHeader(header) {
+		ar.raw = true
+		return header, rawStreamType, nil
 	}
 
 	size := int(binary.BigEndian.Uint32(header[4:]))
+	if limit := ar.frameLimit(); size > limit {
+		return nil, 0, fmt.Errorf("docker frame declares %d bytes, exceeding the max frame size of %d", size, limit)
+	}
 	data := make([]byte, size)
 	_, err = io.ReadFull(ar.reader, data)
 	if err != nil {
-		return 0, err
+		return nil, 0, err
 	}
 
-	n := copy(p, data)
-	if n < len(data) {
-		ar.buffer = data[n:]
+	return data, header[0], nil
+}
+
+func (ar *adaptiveReader) frameLimit() int {
+	if ar.maxFrameSize > 0 {
+		return ar.maxFrameSize
 	}
-	return n, nil
+	return defaultMaxFrameSize
+}
+
+// isDockerHeader reports whether header looks like a multiplexed stream header:
+// a stream type of stdin, stdout or stderr followed by three zero padding bytes
+func isDockerHeader(header []byte) bool {
+	return header[0] <= 2 && header[1] == 0 && header[2] == 0 && header[3] == 0
 }
 
 func TestAdaptiveReader(t *testing.T) {
@@ -56,9 +129,9 @@ func TestAdaptiveReader(t *testing.T) {
 		{
 			name: "standard docker stream",
 			input: append([]byte{
-				1,                // stream type
-				0, 0, 0,         // padding
-				0, 0, 0, 5,      // size (5 bytes)
+				1,       // stream type
+				0, 0, 0, // padding
+				0, 0, 0, 5, // size (5 bytes)
 				'h', 'e', 'l', 'l', 'o', // actual data
 			}),
 			readSize:    10,
@@ -69,9 +142,9 @@ func TestAdaptiveReader(t *testing.T) {
 		{
 			name: "stderr docker stream",
 			input: append([]byte{
-				2,                // stream type (stderr)
-				0, 0, 0,         // padding
-				0, 0, 0, 4,      // size (4 bytes)
+				2,       // stream type (stderr)
+				0, 0, 0, // padding
+				0, 0, 0, 4, // size (4 bytes)
 				't', 'e', 's', 't', // actual data
 			}),
 			readSize:    10,
@@ -82,9 +155,9 @@ func TestAdaptiveReader(t *testing.T) {
 		{
 			name: "small buffer requiring multiple reads",
 			input: append([]byte{
-				1,                // stream type
-				0, 0, 0,         // padding
-				0, 0, 0, 6,      // size (6 bytes)
+				1,       // stream type
+				0, 0, 0, // padding
+				0, 0, 0, 6, // size (6 bytes)
 				'b', 'u', 'f', 'f', 'e', 'r', // actual data
 			}),
 			readSize:    2,
@@ -95,15 +168,23 @@ func TestAdaptiveReader(t *testing.T) {
 		{
 			name: "invalid stream type",
 			input: append([]byte{
-				3,                // invalid stream type
-				0, 0, 0,         // padding
-				0, 0, 0, 4,      // size
+				3,       // invalid stream type
+				0, 0, 0, // padding
+				0, 0, 0, 4, // size
 				't', 'e', 's', 't', // data
 			}),
 			readSize:    10,
-			wantData:    nil,
-			wantErr:     io.ErrUnexpectedEOF,
-			description: "Should return error for invalid stream type",
+			wantData:    []byte{3, 0, 0, 0, 0, 0, 0, 4},
+			wantErr:     nil,
+			description: "Should pass through a stream that is not Docker multiplexed",
+		},
+		{
+			name:        "partial header",
+			input:       []byte{1, 2, 3},
+			readSize:    10,
+			wantData:    []byte{1, 2, 3},
+			wantErr:     nil,
+			description: "Should return data shorter than a header as raw data",
 		},
 		{
 			name:        "empty input",
@@ -151,7 +232,7 @@ func TestAdaptiveReader(t *testing.T) {
 func TestMultipleReads(t *testing.T) {
 	// Create a Docker stream with 10 bytes of data
 	input := append([]byte{
-		1,    // stream type
+		1,       // stream type
 		0, 0, 0, // padding
 		0, 0, 0, 10, // size (10 bytes)
 	}, []byte("helloworld")...)
@@ -195,4 +276,159 @@ func TestMultipleReads(t *testing.T) {
 	if err != io.EOF {
 		t.Errorf("Fourth read: got error %v, want EOF", err)
 	}
-}
\ No newline at end of file
+}
+
+func TestAdaptiveReader_TTYStream(t *testing.T) {
+	// A TTY container writes its output without multiplexing headers
+	input := []byte("{\"type\": \"result\", \"results\": {}}\nStop container\n")
+
+	ar := &adaptiveReader{
+		reader: bytes.NewReader(input),
+	}
+
+	var got []byte
+	buf := make([]byte, 5)
+	for {
+		n, err := ar.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read() unexpected error: %v", err)
+		}
+	}
+
+	if !bytes.Equal(got, input) {
+		t.Errorf("Read() = %q, want %q", got, input)
+	}
+}
+
+func TestAdaptiveReader_MaxFrameSize(t *testing.T) {
+	// Header claiming a 4GB frame, with no payload behind it
+	input := []byte{
+		1,       // stream type
+		0, 0, 0, // padding
+		0xff, 0xff, 0xff, 0xff, // size
+	}
+
+	ar := &adaptiveReader{
+		reader:       bytes.NewReader(input),
+		maxFrameSize: 1024,
+	}
+
+	buf := make([]byte, 10)
+	n, err := ar.Read(buf)
+	if err == nil {
+		t.Fatalf("Read() expected error for a frame larger than maxFrameSize")
+	}
+	if n != 0 {
+		t.Errorf("Read() n = %v, want 0", n)
+	}
+}
+
+// frame builds a Docker multiplexed frame for tests
+func frame(streamType byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = streamType
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestAdaptiveReader_ReadSkipsEmptyFrames(t *testing.T) {
+	ar := &adaptiveReader{
+		reader: bytes.NewReader(append(append(frame(1, ""), frame(1, "")...), frame(1, "data")...)),
+	}
+
+	buf := make([]byte, 10)
+	n, err := ar.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() unexpected error: %v", err)
+	}
+	if string(buf[:n]) != "data" {
+		t.Errorf("Read() = %q, want %q", buf[:n], "data")
+	}
+
+	if _, err := ar.Read(buf); err != io.EOF {
+		t.Errorf("Read() at end of stream error = %v, want EOF", err)
+	}
+}
+
+func TestAdaptiveReader_ReadMessage(t *testing.T) {
+	type message struct {
+		data       string
+		streamType byte
+	}
+	tests := []struct {
+		name  string
+		input []byte
+		want  []message
+	}{
+		{
+			name:  "single frame",
+			input: frame(1, "hello world"),
+			want:  []message{{"hello world", 1}},
+		},
+		{
+			name:  "multiple frames",
+			input: append(append(frame(1, "first"), frame(2, "error")...), frame(1, "second")...),
+			want:  []message{{"first", 1}, {"error", 2}, {"second", 1}},
+		},
+		{
+			name:  "empty frame",
+			input: append(frame(1, ""), frame(1, "after")...),
+			want:  []message{{"", 1}, {"after", 1}},
+		},
+		{
+			name:  "empty input",
+			input: []byte{},
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar := &adaptiveReader{
+				reader: bytes.NewReader(tt.input),
+			}
+
+			for i, want := range tt.want {
+				data, streamType, err := ar.ReadMessage()
+				if err != nil {
+					t.Fatalf("ReadMessage() #%d unexpected error: %v", i, err)
+				}
+				if string(data) != want.data || streamType != want.streamType {
+					t.Errorf("ReadMessage() #%d = %q, %d, want %q, %d", i, data, streamType, want.data, want.streamType)
+				}
+			}
+
+			if _, _, err := ar.ReadMessage(); err != io.EOF {
+				t.Errorf("ReadMessage() at end of stream error = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestAdaptiveReader_ReadMessageAfterRead(t *testing.T) {
+	ar := &adaptiveReader{
+		reader: bytes.NewReader(append(frame(2, "helloworld"), frame(1, "next")...)),
+	}
+
+	buf := make([]byte, 4)
+	if _, err := ar.Read(buf); err != nil {
+		t.Fatalf("Read() unexpected error: %v", err)
+	}
+
+	data, streamType, err := ar.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() unexpected error: %v", err)
+	}
+	if string(data) != "oworld" || streamType != 2 {
+		t.Errorf("ReadMessage() = %q, %d, want %q, 2", data, streamType, "oworld")
+	}
+
+	data, streamType, err = ar.ReadMessage()
+	if err != nil || string(data) != "next" || streamType != 1 {
+		t.Errorf("ReadMessage() = %q, %d, %v, want %q, 1, nil", data, streamType, err, "next")
+	}
+}
@@ -0,0 +1,295 @@
+package containerpool
+
+import (
+	"context"
+	"datafeedctl/internal/app/logz"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TenantPoolLimits sizes the sub-pool reserved for a single tenant
+type TenantPoolLimits struct {
+	MinContainers int
+	MaxContainers int
+}
+
+// TenantContainerPool partitions containers into one ContainerPool per tenant, so a tenant
+// that saturates its own sub-pool cannot take containers reserved for another tenant.
+// A tenant at its max may borrow from a shared overflow pool while fewer than overflowCap
+// overflow containers are lent out across all tenants.
+type TenantContainerPool struct {
+	mu            sync.Mutex
+	pools         map[string]*tenantPoolEntry
+	limits        map[string]TenantPoolLimits
+	defaultLimits TenantPoolLimits
+	idleTimeout   time.Duration
+	imageName     string
+	closed        bool
+
+	// stateFile is the base of the per-pool state files, each sub-pool and the overflow
+	// pool persist to their own file next to it. Empty disables persistence.
+	stateFile string
+
+	overflow      *ContainerPool
+	overflowCap   int
+	overflowInUse int
+
+	// owners maps a handed out container to the tenant and pool it must be released to
+	owners map[*DockerContainer]tenantLease
+
+	newPool func(stateFile string, minSize, maxSize int) (*ContainerPool, error)
+}
+
+type tenantLease struct {
+	tenant string
+	pool   *ContainerPool
+}
+
+// tenantPoolEntry lets other callers wait for a sub-pool being created without holding
+// tp.mu while its containers start
+type tenantPoolEntry struct {
+	ready chan struct{} // closed once pool or err is set
+	pool  *ContainerPool
+	err   error
+}
+
+// NewTenantContainerPool creates a partitioned pool. Per-tenant limits are read from
+// worker.tenant_pools.<tenant>.min_containers / max_containers and default to defaultLimits.
+// overflowSize of zero disables the shared overflow pool.
+func NewTenantContainerPool(defaultLimits TenantPoolLimits, overflowSize, overflowCap int, idleTimeout time.Duration, imageName string) (*TenantContainerPool, error) {
+	if defaultLimits.MinContainers > defaultLimits.MaxContainers {
+		return nil, fmt.Errorf("minimum size cannot be greater than maximum size")
+	}
+
+	tp := &TenantContainerPool{
+		pools:         make(map[string]*tenantPoolEntry),
+		limits:        make(map[string]TenantPoolLimits),
+		defaultLimits: defaultLimits,
+		idleTimeout:   idleTimeout,
+		imageName:     imageName,
+		overflowCap:   overflowCap,
+		stateFile:     viper.GetString("worker.container_state_file"),
+		owners:        make(map[*DockerContainer]tenantLease),
+	}
+	tp.newPool = func(stateFile string, minSize, maxSize int) (*ContainerPool, error) {
+		return NewContainerPoolWithStateFile(minSize, maxSize, tp.idleTimeout, tp.imageName, stateFile)
+	}
+
+	if overflowSize > 0 {
+		overflow, err := tp.newPool(tp.poolStateFile("overflow"), 0, overflowSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create overflow pool: %v", err)
+		}
+		tp.overflow = overflow
+	}
+
+	return tp, nil
+}
+
+// SetTenantLimits overrides the limits of a tenant whose sub-pool has not been created yet
+func (tp *TenantContainerPool) SetTenantLimits(tenant string, limits TenantPoolLimits) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.limits[tenant] = limits
+}
+
+func (tp *TenantContainerPool) GetContainer(tenant string) *DockerContainer {
+	con, err := tp.GetContainerContext(context.Background(), tenant)
+	if err != nil {
+		logz.Error(err.Error())
+		return nil
+	}
+	return con
+}
+
+// GetContainerContext hands out a container from the tenant's sub-pool, borrowing from the
+// overflow pool when the sub-pool is exhausted, and otherwise waits on the sub-pool.
+func (tp *TenantContainerPool) GetContainerContext(ctx context.Context, tenant string) (*DockerContainer, error) {
+	pool, err := tp.tenantPool(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	con, err := pool.TryGetContainer()
+	if err == nil {
+		tp.lease(con, tenant, pool)
+		return con, nil
+	}
+	if err != ErrPoolExhausted {
+		return nil, err
+	}
+
+	if tp.reserveOverflow() {
+		con, err := tp.overflow.TryGetContainer()
+		if err == nil {
+			tp.lease(con, tenant, tp.overflow)
+			return con, nil
+		}
+		tp.releaseOverflow()
+	}
+
+	con, err = pool.GetContainerContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %v", tenant, err)
+	}
+	tp.lease(con, tenant, pool)
+	return con, nil
+}
+
+// ReleaseContainer returns a container to the pool it was taken from
+func (tp *TenantContainerPool) ReleaseContainer(con *DockerContainer) {
+	tp.mu.Lock()
+	lease, exists := tp.owners[con]
+	if exists {
+		delete(tp.owners, con)
+		if lease.pool == tp.overflow {
+			tp.overflowInUse--
+		}
+	}
+	tp.mu.Unlock()
+
+	if exists {
+		lease.pool.ReleaseContainer(con)
+	}
+}
+
+// Shutdown stops accepting gets, then shuts down every tenant sub-pool and the overflow
+// pool, waiting for busy containers until ctx is done. It returns the first error.
+func (tp *TenantContainerPool) Shutdown(ctx context.Context) error {
+	tp.mu.Lock()
+	if tp.closed {
+		tp.mu.Unlock()
+		return ErrPoolClosed
+	}
+	tp.closed = true
+	pools := make([]*ContainerPool, 0, len(tp.pools)+1)
+	for _, entry := range tp.pools {
+		select {
+		case <-entry.ready:
+			if entry.pool != nil {
+				pools = append(pools, entry.pool)
+			}
+		default:
+			// Still being created, tenantPool shuts it down once it sees closed
+		}
+	}
+	if tp.overflow != nil {
+		pools = append(pools, tp.overflow)
+	}
+	tp.mu.Unlock()
+
+	var firstErr error
+	for _, pool := range pools {
+		if err := pool.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// tenantPool returns the tenant's sub-pool, creating it on first use. Creation starts
+// containers, so it runs outside tp.mu and other tenants are not held up.
+func (tp *TenantContainerPool) tenantPool(ctx context.Context, tenant string) (*ContainerPool, error) {
+	tp.mu.Lock()
+	if tp.closed {
+		tp.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	if entry, exists := tp.pools[tenant]; exists {
+		tp.mu.Unlock()
+		select {
+		case <-entry.ready:
+			return entry.pool, entry.err
+		case <-ctx.Done():
+			return nil, fmt.Errorf("tenant %s: waiting for pool creation: %v", tenant, ctx.Err())
+		}
+	}
+
+	entry := &tenantPoolEntry{ready: make(chan struct{})}
+	tp.pools[tenant] = entry
+	limits := tp.limitsFor(tenant)
+	tp.mu.Unlock()
+
+	pool, err := tp.newPool(tp.poolStateFile("tenant-"+url.PathEscape(tenant)), limits.MinContainers, limits.MaxContainers)
+
+	tp.mu.Lock()
+	switch {
+	case err != nil:
+		err = fmt.Errorf("failed to create pool for tenant %s: %v", tenant, err)
+		// Drop the entry so a later get can retry
+		delete(tp.pools, tenant)
+	case tp.closed:
+		err = ErrPoolClosed
+		delete(tp.pools, tenant)
+	}
+	closed := tp.closed
+	tp.mu.Unlock()
+
+	if closed && pool != nil {
+		if shutdownErr := pool.Shutdown(context.Background()); shutdownErr != nil {
+			logz.Error(fmt.Sprintf("failed to shut down pool for tenant %s: %v", tenant, shutdownErr))
+		}
+		pool = nil
+	}
+
+	entry.pool, entry.err = pool, err
+	close(entry.ready)
+	return pool, err
+}
+
+// limitsFor resolves a tenant's limits. The caller must hold tp.mu.
+func (tp *TenantContainerPool) limitsFor(tenant string) TenantPoolLimits {
+	if limits, exists := tp.limits[tenant]; exists {
+		return limits
+	}
+
+	limits := tp.defaultLimits
+	key := fmt.Sprintf("worker.tenant_pools.%s", tenant)
+	if viper.IsSet(key + ".min_containers") {
+		limits.MinContainers = viper.GetInt(key + ".min_containers")
+	}
+	if viper.IsSet(key + ".max_containers") {
+		limits.MaxContainers = viper.GetInt(key + ".max_containers")
+	}
+	return limits
+}
+
+// poolStateFile returns the state file of one pool, named after stateFile
+func (tp *TenantContainerPool) poolStateFile(name string) string {
+	if tp.stateFile == "" {
+		return ""
+	}
+	return tp.stateFile + "." + name
+}
+
+// reserveOverflow claims one of the overflowCap overflow slots shared by all tenants
+func (tp *TenantContainerPool) reserveOverflow() bool {
+	if tp.overflow == nil {
+		return false
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	if tp.overflowInUse >= tp.overflowCap {
+		return false
+	}
+	tp.overflowInUse++
+	return true
+}
+
+func (tp *TenantContainerPool) releaseOverflow() {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.overflowInUse--
+}
+
+func (tp *TenantContainerPool) lease(con *DockerContainer, tenant string, pool *ContainerPool) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.owners[con] = tenantLease{tenant: tenant, pool: pool}
+}
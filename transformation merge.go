@@ -0,0 +1,35 @@
+package transformation
+
+// mergePath lists the levels of a DataTransformationDetail that Merge descends into:
+// job -> input_transformation -> source -> fields. "*" matches any key. Below the last
+// level, and for any key not on the path, the override value replaces the base value.
+var mergePath = []string{"*", "input_transformation", "*", "fields"}
+
+// Merge combines a base config with an override config. The override wins per job, source
+// and field: a field present in override replaces the base field as a whole, other source
+// keys such as raw_text or target_field are replaced individually, and anything only in
+// base is kept. Neither argument is modified.
+func Merge(base, override DataTransformationDetail) DataTransformationDetail {
+	return mergeMap(base, override, mergePath)
+}
+
+func mergeMap(base, override map[string]interface{}, path []string) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+
+	for key, value := range override {
+		if len(path) > 0 && (path[0] == "*" || path[0] == key) {
+			baseValue, baseOk := merged[key].(map[string]interface{})
+			overrideValue, overrideOk := value.(map[string]interface{})
+			if baseOk && overrideOk {
+				merged[key] = mergeMap(baseValue, overrideValue, path[1:])
+				continue
+			}
+		}
+		merged[key] = value
+	}
+
+	return merged
+}
@@ -0,0 +1,65 @@
+package transformation
+
+import (
+	"fmt"
+	"sort"
+)
+
+// StepResult is the value produced by a single step of a field transformation chain
+type StepResult struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Output string `json:"output"`
+}
+
+// Preview runs the chain against input one step at a time, in Index order, and returns
+// the intermediate value after each step. The last element holds the final result,
+// the same value ApplyTransformFunctions would return for input.
+func (f *FieldTransformationDetail) Preview(input string) ([]StepResult, error) {
+	if !f.isInitialized() {
+		if err := f.InitializeTransformFunctions(); err != nil {
+			return nil, fmt.Errorf("failed to initialize transform functions for field '%s': %w", f.FieldName, err)
+		}
+	}
+
+	steps := make([]TransformationFunctionDetail, len(f.TransformFunctionDetails))
+	copy(steps, f.TransformFunctionDetails)
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].Index < steps[j].Index
+	})
+
+	results := make([]StepResult, 0, len(steps))
+	current := input
+	for _, step := range steps {
+		single := FieldTransformationDetail{
+			FieldName:                f.FieldName,
+			TransformFunctionDetails: []TransformationFunctionDetail{step},
+		}
+
+		output, err := single.ApplyTransformFunctions(current)
+		if err != nil {
+			return results, fmt.Errorf("transform function '%s' at index %d failed: %w", step.Name, step.Index, err)
+		}
+
+		results = append(results, StepResult{
+			Index:  step.Index,
+			Name:   step.Name,
+			Type:   step.Type,
+			Output: output,
+		})
+		current = output
+	}
+
+	return results, nil
+}
+
+// isInitialized reports whether every function in the chain has been resolved
+func (f *FieldTransformationDetail) isInitialized() bool {
+	for _, detail := range f.TransformFunctionDetails {
+		if detail.TransformationFunction == nil {
+			return false
+		}
+	}
+	return true
+}
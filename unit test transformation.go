@@ -1,8 +1,8 @@
 package transformation
 
 import (
-	"testing"
 	"github.com/stretchr/testify/assert"
+	"testing"
 )
 
 func TestDataTransformationDetail_GetInputTransformationDetail(t *testing.T) {
@@ -213,4 +213,107 @@ func TestDataTransformationDetail_GetInputTransformationDetail_DeepValidation(t
 			assert.Equal(t, "_suffix", content["suffix"])
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestMerge(t *testing.T) {
+	base := DataTransformationDetail{
+		"job1": map[string]interface{}{
+			"input_transformation": map[string]interface{}{
+				"source1": map[string]interface{}{
+					"raw_text":     "Hello ${name}",
+					"target_field": "greeting",
+					"fields": map[string]interface{}{
+						"field1": map[string]interface{}{
+							"field_name": "name",
+						},
+						"field2": map[string]interface{}{
+							"field_name": "title",
+						},
+					},
+				},
+				"source2": map[string]interface{}{
+					"raw_text": "base source2",
+				},
+			},
+		},
+		"job2": map[string]interface{}{
+			"input_transformation": map[string]interface{}{},
+		},
+	}
+	override := DataTransformationDetail{
+		"job1": map[string]interface{}{
+			"input_transformation": map[string]interface{}{
+				"source1": map[string]interface{}{
+					"raw_text": "Hi ${name}",
+					"fields": map[string]interface{}{
+						"field1": map[string]interface{}{
+							"field_name": "tenant_name",
+						},
+					},
+				},
+			},
+		},
+		"job3": map[string]interface{}{
+			"input_transformation": map[string]interface{}{},
+		},
+	}
+
+	merged := Merge(base, override)
+
+	assert.Contains(t, merged, "job1")
+	assert.Contains(t, merged, "job2")
+	assert.Contains(t, merged, "job3")
+
+	sources := merged["job1"].(map[string]interface{})["input_transformation"].(map[string]interface{})
+	source1 := sources["source1"].(map[string]interface{})
+	assert.Equal(t, "Hi ${name}", source1["raw_text"])
+	assert.Equal(t, "greeting", source1["target_field"])
+	assert.Equal(t, "base source2", sources["source2"].(map[string]interface{})["raw_text"])
+
+	fields := source1["fields"].(map[string]interface{})
+	assert.Equal(t, "tenant_name", fields["field1"].(map[string]interface{})["field_name"])
+	assert.Equal(t, "title", fields["field2"].(map[string]interface{})["field_name"])
+
+	// Merge must not modify its arguments
+	baseSource1 := base["job1"].(map[string]interface{})["input_transformation"].(map[string]interface{})["source1"].(map[string]interface{})
+	assert.Equal(t, "Hello ${name}", baseSource1["raw_text"])
+	assert.NotContains(t, base, "job3")
+}
+
+func TestMerge_OverrideReplacesField(t *testing.T) {
+	base := DataTransformationDetail{
+		"job1": map[string]interface{}{
+			"input_transformation": map[string]interface{}{
+				"source1": map[string]interface{}{
+					"fields": map[string]interface{}{
+						"field1": map[string]interface{}{
+							"field_name": "name",
+							"functions": []interface{}{
+								map[string]interface{}{"name": "Concat", "type": "Concat", "index": 0},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	override := DataTransformationDetail{
+		"job1": map[string]interface{}{
+			"input_transformation": map[string]interface{}{
+				"source1": map[string]interface{}{
+					"fields": map[string]interface{}{
+						"field1": map[string]interface{}{
+							"field_name": "name",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	merged := Merge(base, override)
+
+	field1 := merged["job1"].(map[string]interface{})["input_transformation"].(map[string]interface{})["source1"].(map[string]interface{})["fields"].(map[string]interface{})["field1"].(map[string]interface{})
+	assert.NotContains(t, field1, "functions")
+	assert.Equal(t, "name", field1["field_name"])
+}
@@ -311,4 +311,44 @@ func TestFieldTransformationDetail_DeepValidation(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestFieldTransformationDetail_Preview(t *testing.T) {
+	detail := FieldTransformationDetail{
+		FieldName: "preview_field",
+		TransformFunctionDetails: []TransformationFunctionDetail{
+			{
+				Name:  "Concat",
+				Type:  "Concat",
+				Index: 1,
+				Content: map[string]interface{}{
+					"prefix": "start_",
+					"suffix": "_end",
+				},
+			},
+			{
+				Name:  "Concat",
+				Type:  "Concat",
+				Index: 0,
+				Content: map[string]interface{}{
+					"prefix": "prefix_",
+					"suffix": "_middle",
+				},
+			},
+		},
+	}
+
+	// Preview must initialize the functions itself
+	steps, err := detail.Preview("test")
+	assert.NoError(t, err)
+	assert.Len(t, steps, 2)
+
+	assert.Equal(t, 0, steps[0].Index)
+	assert.Equal(t, "prefix_test_middle", steps[0].Output)
+	assert.Equal(t, 1, steps[1].Index)
+	assert.Equal(t, "start_prefix_test_middle_end", steps[1].Output)
+
+	// The final step must agree with ApplyTransformFunctions
+	result, err := detail.ApplyTransformFunctions("test")
+	assert.NoError(t, err)
+	assert.Equal(t, result, steps[len(steps)-1].Output)
+}